@@ -0,0 +1,454 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admins can look up a saved playground, tombstone it, for example when it
+// leaks secrets or holds abusive content, and restore it. A tombstoned
+// playground is answered with a 410 Gone. Its content is kept so it can be
+// restored, unless it's purged when tombstoned. The admin endpoints are
+//
+//   GET  /api/v1/admin/playgrounds/{id}            -> look up the playground
+//   POST /api/v1/admin/playgrounds/{id}/tombstone  -> tombstone the playground
+//   POST /api/v1/admin/playgrounds/{id}/restore    -> restore the playground
+//   GET  /api/v1/admin/audit?id={id}               -> list the admin actions
+//
+// and requests must have an 'Authorization: Bearer <token>' header with one
+// of the configured admin tokens.
+//
+// Tombstones are saved in the playground store with the key tombstone/{id}.
+// Each action is recorded in an audit log, saved in the playground store with
+// the keys audit/{time}-{random}, that is never updated nor deleted. An action
+// is recorded as pending before it's done, so it's never done without being
+// recorded, and its outcome is recorded once it's done. Invalid actions
+// are recorded as rejected. Requests without a valid admin token are never
+// saved, so they can't fill the store: they're only logged and counted
+const (
+	tombstonePrefix = "tombstone/"
+	auditPrefix     = "audit/"
+
+	adminPlaygroundsPath = "playgrounds/"
+	adminAuditPath       = "audit"
+	tombstoneSuffix      = "/tombstone"
+	restoreSuffix        = "/restore"
+
+	// actions recorded in the audit log
+	lookupAction    = "lookup"
+	tombstoneAction = "tombstone"
+	restoreAction   = "restore"
+	auditAction     = "audit"
+
+	// status of the actions recorded in the audit log
+	auditPending  = "pending"
+	auditDone     = "done"
+	auditRejected = "rejected"
+	auditFailed   = "failed"
+
+	// number of random chars following the time in an audit key,
+	// so two actions done at the same time don't collide
+	auditKeyRandomLength = 8
+	// max number of audit entries returned by /api/v1/admin/audit
+	maxAuditEntries = 1000
+
+	errTakenDownPlayground = "this playground has been taken down"
+)
+
+// tombstone of a playground, saved as json
+type tombstone struct {
+	Reason string
+	Time   time.Time
+	// the content of the playground was deleted, so
+	// it can't be restored
+	Purged bool
+}
+
+// body of a request to tombstone or restore a playground
+type apiAdminRequest struct {
+	Reason string
+	// delete the content of the playground when tombstoning it
+	Purge bool
+}
+
+// playground returned by an admin lookup. Mode, Config and
+// Query are empty if the content of the playground is missing
+type adminPlaygroundInfo struct {
+	ID        string
+	Found     bool
+	Private   bool
+	ExpiresAt *time.Time `json:",omitempty"`
+	Tombstone *tombstone `json:",omitempty"`
+	Mode      string     `json:",omitempty"`
+	Config    string     `json:",omitempty"`
+	Query     string     `json:",omitempty"`
+}
+
+// entry of the audit log, saved as json
+type auditEntry struct {
+	Time   time.Time
+	Action string `json:",omitempty"`
+	ID     string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+	// first chars of the sha256 of the admin token used, so
+	// actions can be traced without saving the token
+	Admin string
+	// remote address of the request
+	RemoteAddr string
+	Status     string
+	// why the action was rejected or failed
+	Error string `json:",omitempty"`
+}
+
+func tombstoneKey(id []byte) []byte {
+	return append([]byte(tombstonePrefix), id...)
+}
+
+// handle the requests to /api/v1/admin/
+func (s *storage) apiAdminHandler(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, apiAdminEndpoint)
+
+	id, action := []byte(strings.TrimPrefix(path, adminPlaygroundsPath)), lookupAction
+	switch {
+	case path == adminAuditPath:
+		id, action = nil, auditAction
+	case !strings.HasPrefix(path, adminPlaygroundsPath):
+		id, action = []byte(path), ""
+	case strings.HasSuffix(string(id), tombstoneSuffix):
+		id, action = id[:len(id)-len(tombstoneSuffix)], tombstoneAction
+	case strings.HasSuffix(string(id), restoreSuffix):
+		id, action = id[:len(id)-len(restoreSuffix)], restoreAction
+	}
+	entry := auditEntry{
+		Action:     action,
+		ID:         string(id),
+		RemoteAddr: r.RemoteAddr,
+	}
+
+	token, ok := bearerToken(r, s.adminTokens)
+	if !ok {
+		log.Printf("unauthorized admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		adminUnauthorizedRequests.Inc()
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, &playgroundError{kind: authError, msg: "a valid admin token is required"})
+		return
+	}
+	entry.Admin = tokenFingerprint(token)
+
+	if action == auditAction {
+		if r.Method != http.MethodGet {
+			s.recordRejection(entry, fmt.Errorf("method %s is not allowed", r.Method))
+			allowOnly(w, r, http.MethodGet)
+			return
+		}
+		s.apiAuditHandler(w, r)
+		return
+	}
+	if action == "" {
+		s.rejectAdminRequest(w, entry, newPlaygroundError(notFoundError, "unknown admin endpoint %s", r.URL.Path))
+		return
+	}
+	if !isPageKey(id) {
+		s.rejectAdminRequest(w, entry, newPlaygroundError(requestError, "invalid playground id '%s'", id))
+		return
+	}
+
+	method := http.MethodPost
+	if action == lookupAction {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		s.recordRejection(entry, fmt.Errorf("method %s is not allowed", r.Method))
+		allowOnly(w, r, method)
+		return
+	}
+	var req apiAdminRequest
+	if action != lookupAction {
+		if err := limitBody(r); err != nil {
+			s.rejectAdminRequest(w, entry, err)
+			return
+		}
+		// the body is optional
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if errors.Is(err, errBodyTooBig) {
+			s.rejectAdminRequest(w, entry, err)
+			return
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.rejectAdminRequest(w, entry, newPlaygroundError(requestError, "invalid request body: %v", err))
+			return
+		}
+	}
+	entry.Reason = req.Reason
+
+	// the action is recorded before it's done, and
+	// isn't done if it can't be recorded
+	entry.Status = auditPending
+	if err := s.recordAuditEntry(entry); err != nil {
+		log.Printf("fail to record admin action %s on playground %s: %v", action, id, err)
+		writeAPIError(w, err)
+		return
+	}
+
+	var resp interface{}
+	var err error
+	switch action {
+	case lookupAction:
+		resp, err = s.lookupPlayground(id)
+	case tombstoneAction:
+		resp, err = s.tombstonePlayground(id, req.Reason, req.Purge)
+	case restoreAction:
+		resp, err = s.restorePlayground(id)
+	}
+
+	entry.Status, entry.Error = auditDone, ""
+	if err != nil {
+		entry.Status, entry.Error = auditStatus(err), err.Error()
+	}
+	if recordErr := s.recordAuditEntry(entry); recordErr != nil {
+		log.Printf("fail to record outcome of admin action %s on playground %s: %v", action, id, recordErr)
+	}
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	adminActions.WithLabelValues(action).Inc()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// record the rejected request in the audit log, and write the error
+func (s *storage) rejectAdminRequest(w http.ResponseWriter, entry auditEntry, err error) {
+	s.recordRejection(entry, err)
+	writeAPIError(w, err)
+}
+
+func (s *storage) recordRejection(entry auditEntry, err error) {
+	entry.Status, entry.Error = auditRejected, err.Error()
+	if recordErr := s.recordAuditEntry(entry); recordErr != nil {
+		log.Printf("fail to record rejected admin action %s: %v", entry.Action, recordErr)
+	}
+}
+
+// returns auditRejected if the action was refused because of the request,
+// like for an unknown playground, and auditFailed otherwise
+func auditStatus(err error) string {
+	var pErr *playgroundError
+	if errors.As(err, &pErr) && pErr.statusCode() < http.StatusInternalServerError {
+		return auditRejected
+	}
+	return auditFailed
+}
+
+// list the most recent entries of the audit log, newest first. If the 'id'
+// query parameter is set, only the actions on this playground are listed
+func (s *storage) apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+
+	entries, err := s.auditLog(r.URL.Query().Get("id"))
+	if err != nil {
+		log.Printf("fail to load audit log: %v", err)
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *storage) lookupPlayground(id []byte) (*adminPlaygroundInfo, error) {
+
+	records, err := s.loadPageRecords(id)
+	if err != nil {
+		return nil, err
+	}
+	info := &adminPlaygroundInfo{
+		ID:        string(id),
+		Private:   records.access != nil,
+		Tombstone: records.tombstone,
+	}
+	if !records.expiresAt.IsZero() {
+		info.ExpiresAt = &records.expiresAt
+	}
+
+	p, err := s.loadPage(id)
+	if err != nil && !errors.Is(err, errPlaygroundNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		info.Found = true
+		info.Mode, info.Config, info.Query = p.modeName(), string(p.Config), string(p.Query)
+	}
+	if !info.Found && info.Tombstone == nil && info.ExpiresAt == nil {
+		return nil, newPlaygroundError(notFoundError, "no playground with id '%s'", id)
+	}
+	return info, nil
+}
+
+// tombstone the playground with this id. If purge is true, its content
+// is deleted. Tombstoning a playground again updates its tombstone, and
+// can be used to purge it
+func (s *storage) tombstonePlayground(id []byte, reason string, purge bool) (*tombstone, error) {
+
+	if _, err := s.store.get(id); err != nil && s.tombstone(id) == nil {
+		if errors.Is(err, errPlaygroundNotFound) {
+			return nil, newPlaygroundError(notFoundError, "no playground with id '%s'", id)
+		}
+		return nil, err
+	}
+
+	t := &tombstone{Reason: reason, Time: time.Now().UTC()}
+	err := s.store.update(tombstoneKey(id), func(old []byte) ([]byte, error) {
+		if old != nil {
+			var previous tombstone
+			if err := json.Unmarshal(old, &previous); err == nil && previous.Purged {
+				t.Purged = true
+			}
+		}
+		t.Purged = t.Purged || purge
+		return json.Marshal(t)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to save tombstone: %v", err)
+	}
+
+	if purge {
+		if err := s.purgePage(id); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// delete the content of the page, and release its configuration blob
+func (s *storage) purgePage(id []byte) error {
+
+	var ref []byte
+	err := s.store.update(id, func(old []byte) ([]byte, error) {
+		ref = configRef(old)
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail to purge playground: %v", err)
+	}
+	if ref != nil {
+		return s.releaseConfigBlob(ref)
+	}
+	return nil
+}
+
+// remove the tombstone of the playground with this id. Purged
+// playgrounds can't be restored
+func (s *storage) restorePlayground(id []byte) (*adminPlaygroundInfo, error) {
+
+	t := s.tombstone(id)
+	if t == nil {
+		return nil, newPlaygroundError(conflictError, "playground '%s' is not tombstoned", id)
+	}
+	if t.Purged {
+		return nil, newPlaygroundError(conflictError, "playground '%s' was purged and can't be restored", id)
+	}
+	if err := s.store.delete(tombstoneKey(id)); err != nil {
+		return nil, fmt.Errorf("fail to delete tombstone: %v", err)
+	}
+	return s.lookupPlayground(id)
+}
+
+// returns the tombstone of the playground with this
+// id, or nil if it's not tombstoned
+func (s *storage) tombstone(id []byte) *tombstone {
+	v, err := s.store.get(tombstoneKey(id))
+	if err != nil {
+		return nil
+	}
+	return decodeTombstone(id, v)
+}
+
+func decodeTombstone(id, v []byte) *tombstone {
+	var t tombstone
+	if err := json.Unmarshal(v, &t); err != nil {
+		log.Printf("invalid tombstone for playground %s: %v", id, err)
+	}
+	return &t
+}
+
+// append the entry to the audit log
+func (s *storage) recordAuditEntry(entry auditEntry) error {
+
+	entry.Time = time.Now().UTC()
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	random := make([]byte, auditKeyRandomLength)
+	for i := 0; i < maxRandomIDAttempts; i++ {
+		if err := randomURLSafe(random); err != nil {
+			return err
+		}
+		// the time is hex encoded with a fixed length,
+		// so entries are iterated in chronological order
+		key := fmt.Sprintf("%s%016x-%s", auditPrefix, entry.Time.UnixNano(), random)
+		inserted, err := s.store.putIfAbsent([]byte(key), v)
+		if err != nil || inserted {
+			return err
+		}
+	}
+	return errTooManyCollisions
+}
+
+// returns the last maxAuditEntries entries of the audit log, newest
+// first. If id is not empty, only the actions on this playground are
+// returned
+func (s *storage) auditLog(id string) ([]auditEntry, error) {
+
+	entries := make([]auditEntry, 0)
+	err := s.store.iteratePrefix([]byte(auditPrefix), true, func(key, val []byte) error {
+		var entry auditEntry
+		if err := json.Unmarshal(val, &entry); err != nil {
+			return fmt.Errorf("invalid audit entry %s: %v", key, err)
+		}
+		if id == "" || entry.ID == id {
+			entries = append(entries, entry)
+		}
+		if len(entries) >= maxAuditEntries {
+			return errStopIteration
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// identifies a token in logs without revealing it
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+func serveTakenDownPlayground(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte(errTakenDownPlayground))
+}
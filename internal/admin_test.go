@@ -0,0 +1,221 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testAdminToken = "admin-token"
+
+func TestAdminTakedown(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{store: newMemoryStore(), adminTokens: []string{testAdminToken}}
+
+	id, _, _ := s.save(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte("db.collection.find()")})
+	bigConfig := []byte(`[{"k":"` + strings.Repeat("a", minConfigBlobSize) + `"}]`)
+	big, _, _ := s.save(&page{Mode: bsonMode, Config: bigConfig, Query: []byte("db.collection.find()")})
+	private := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Private":true}`)
+
+	adminTests := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		token        string
+		responseCode int
+		// response code of /p/{id} after the request
+		viewCode int
+	}{
+		{
+			name:         "without token",
+			method:       http.MethodGet,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id),
+			token:        "invalid",
+			responseCode: http.StatusUnauthorized,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "lookup",
+			method:       http.MethodGet,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id),
+			token:        testAdminToken,
+			responseCode: http.StatusOK,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "lookup unknown playground",
+			method:       http.MethodGet,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + "aaaaaaaaaaa",
+			token:        testAdminToken,
+			responseCode: http.StatusNotFound,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "tombstone with wrong method",
+			method:       http.MethodGet,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + tombstoneSuffix,
+			token:        testAdminToken,
+			responseCode: http.StatusMethodNotAllowed,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "restore playground not tombstoned",
+			method:       http.MethodPost,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + restoreSuffix,
+			token:        testAdminToken,
+			responseCode: http.StatusConflict,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "tombstone",
+			method:       http.MethodPost,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + tombstoneSuffix,
+			body:         `{"Reason":"leaked credentials"}`,
+			token:        testAdminToken,
+			responseCode: http.StatusOK,
+			viewCode:     http.StatusGone,
+		},
+		{
+			name:         "restore",
+			method:       http.MethodPost,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + restoreSuffix,
+			token:        testAdminToken,
+			responseCode: http.StatusOK,
+			viewCode:     http.StatusOK,
+		},
+		{
+			name:         "tombstone and purge",
+			method:       http.MethodPost,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + tombstoneSuffix,
+			body:         `{"Reason":"abusive content","Purge":true}`,
+			token:        testAdminToken,
+			responseCode: http.StatusOK,
+			viewCode:     http.StatusGone,
+		},
+		{
+			name:         "restore purged playground",
+			method:       http.MethodPost,
+			url:          apiAdminEndpoint + adminPlaygroundsPath + string(id) + restoreSuffix,
+			token:        testAdminToken,
+			responseCode: http.StatusConflict,
+			viewCode:     http.StatusGone,
+		},
+	}
+
+	unauthorized := testutil.ToFloat64(adminUnauthorizedRequests)
+
+	for _, tt := range adminTests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp := httptest.NewRecorder()
+			s.apiAdminHandler(resp, req)
+
+			if want, got := tt.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d: %s", want, got, resp.Body)
+			}
+
+			resp = httptest.NewRecorder()
+			s.viewHandler(resp, httptest.NewRequest(http.MethodGet, viewEndpoint+string(id)+queryExportSuffix, nil))
+			if want, got := tt.viewCode, resp.Code; want != got {
+				t.Errorf("expected view response code %d but got %d", want, got)
+			}
+		})
+	}
+
+	// the configuration blob of a purged playground is released
+	adminRequest(t, s, http.MethodPost, apiAdminEndpoint+adminPlaygroundsPath+string(big)+tombstoneSuffix, `{"Purge":true}`)
+	if want, got := 0, countConfigBlobRefs(t, s.store, bigConfig); want != got {
+		t.Errorf("expected %d references to the configuration blob but got %d", want, got)
+	}
+
+	// a tombstoned private playground is only reported as taken down with its token
+	adminRequest(t, s, http.MethodPost, apiAdminEndpoint+adminPlaygroundsPath+private.ID+tombstoneSuffix, "")
+	for token, want := range map[string]int{"": http.StatusNotFound, private.Token: http.StatusGone} {
+		resp := httptest.NewRecorder()
+		s.viewHandler(resp, httptest.NewRequest(http.MethodGet, viewEndpoint+private.ID+"?token="+token, nil))
+		if got := resp.Code; want != got {
+			t.Errorf("expected view response code %d but got %d", want, got)
+		}
+	}
+
+	var entries []auditEntry
+	json.Unmarshal(adminRequest(t, s, http.MethodGet, apiAdminEndpoint+adminAuditPath+"?id="+string(id), ""), &entries)
+
+	// entries are listed newest first
+	wantEntries := []struct{ action, status string }{
+		{restoreAction, auditRejected},
+		{restoreAction, auditPending},
+		{tombstoneAction, auditDone},
+		{tombstoneAction, auditPending},
+		{restoreAction, auditDone},
+		{restoreAction, auditPending},
+		{tombstoneAction, auditDone},
+		{tombstoneAction, auditPending},
+		{restoreAction, auditRejected},
+		{restoreAction, auditPending},
+		{tombstoneAction, auditRejected},
+		{lookupAction, auditDone},
+		{lookupAction, auditPending},
+	}
+	if len(entries) != len(wantEntries) {
+		t.Fatalf("expected %d audit entries but got %d: %+v", len(wantEntries), len(entries), entries)
+	}
+	for i, entry := range entries {
+		if want, got := wantEntries[i].action, entry.Action; want != got {
+			t.Errorf("expected action %s but got %s", want, got)
+		}
+		if want, got := wantEntries[i].status, entry.Status; want != got {
+			t.Errorf("expected status %s for action %s but got %s", want, entry.Action, got)
+		}
+	}
+	for _, entry := range entries {
+		if want, got := tokenFingerprint(testAdminToken), entry.Admin; want != got {
+			t.Errorf("expected admin %s but got %s", want, got)
+		}
+	}
+	// requests without a valid token are only counted
+	if want, got := unauthorized+1, testutil.ToFloat64(adminUnauthorizedRequests); want != got {
+		t.Errorf("expected %v unauthorized requests but got %v", want, got)
+	}
+	if want, got := "leaked credentials", entries[7].Reason; want != got {
+		t.Errorf("expected reason %s but got %s", want, got)
+	}
+}
+
+func adminRequest(t *testing.T, s *storage, method, url, body string) []byte {
+
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp := httptest.NewRecorder()
+	s.apiAdminHandler(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("admin request %s %s failed: %d %s", method, url, resp.Code, resp.Body)
+	}
+	return resp.Body.Bytes()
+}
@@ -0,0 +1,302 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// body of a request to /api/v1/run or /api/v1/save
+type apiRequest struct {
+	Mode   string
+	Config string
+	Query  string
+	// format of the result, see output.go. Default to 'shell'.
+	// Ignored by /api/v1/save
+	Output string
+	// id or slug of the playground this one was derived from.
+	// Ignored by /api/v1/run
+	Parent string
+	// save a private playground, only readable with the returned
+	// token and the password if set. Ignored by /api/v1/run
+	Private  bool
+	Password string
+	// save a playground expiring after a day, a week or a month,
+	// with '1d', '1w' or '1m'. Ignored by /api/v1/run
+	Expiry string
+}
+
+// info on the query that produced the result. TotalCount is
+// greater than DocCount if the result was truncated, and is
+// then a lower bound of the number of documents
+type runMetadata struct {
+	ID           string
+	Mode         string
+	Collection   string
+	Method       string
+	ExplainMode  string `json:",omitempty"`
+	Output       string
+	DocCount     int
+	TotalCount   int
+	Truncated    bool
+	Cached       bool
+	DurationMs   int64
+	MongoVersion string
+}
+
+type apiRunResponse struct {
+	// output of the query, in the requested format. bson
+	// output is encoded in base64
+	Result   string
+	Metadata runMetadata
+}
+
+type apiSaveResponse struct {
+	ID  string
+	URL string
+	// read token of a private playground, also part of URL
+	Token string `json:",omitempty"`
+	// expiration date of an expiring playground
+	ExpiresAt *time.Time `json:",omitempty"`
+}
+
+type apiErrorResponse struct {
+	Kind    string
+	Message string
+}
+
+// run a playground and return the result as json, for example:
+//
+//   {
+//     "Result": "[{\"_id\":1}]",
+//     "Metadata": {
+//       "ID": "nJhd-dhf3Ea",
+//       "Mode": "bson_single_collection",
+//       "Collection": "collection",
+//       "Method": "find",
+//       "DocCount": 1,
+//       "DurationMs": 3,
+//       "MongoVersion": "5.0.5"
+//     }
+//   }
+func (s *storage) apiRunHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !allowOnlyPost(w, r) {
+		return
+	}
+
+	p, req, err := decodeAPIRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	output := req.Output
+
+	start := time.Now()
+	res, err := s.run(r.Context(), p)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	b, err := res.format(output)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	result := string(b)
+	if output == bsonOutput {
+		result = base64.StdEncoding.EncodeToString(b)
+	}
+
+	writeJSON(w, http.StatusOK, apiRunResponse{
+		Result: result,
+		Metadata: runMetadata{
+			ID:           string(p.ID()),
+			Mode:         p.label(),
+			Collection:   res.collection,
+			Method:       res.method,
+			ExplainMode:  res.explainMode,
+			Output:       output,
+			DocCount:     res.docCount,
+			TotalCount:   res.totalCount,
+			Truncated:    res.truncated,
+			Cached:       res.cached,
+			DurationMs:   time.Since(start).Milliseconds(),
+			MongoVersion: string(s.mongoVersion()),
+		},
+	})
+}
+
+// save a playground and return its id and url as json. Status
+// code is 201 if the playground is new, 200 if it was already saved
+func (s *storage) apiSaveHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !allowOnlyPost(w, r) {
+		return
+	}
+
+	p, req, err := decodeAPIRequest(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	ttl, err := parseExpiry(req.Expiry)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if req.Private || ttl > 0 {
+		s.apiSaveRandomID(w, r, p, req, ttl)
+		return
+	}
+
+	id, newRecord, err := s.save(p)
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, err)
+		return
+	}
+	if newRecord {
+		if err := s.recordParent(id, s.parentFromRequest(r, req.Parent)); err != nil {
+			log.Printf("fail to record parent of playground %s: %v", id, err)
+		}
+	}
+
+	status := http.StatusOK
+	if newRecord {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, apiSaveResponse{
+		ID:  string(id),
+		URL: playgroundURL(r, id),
+	})
+}
+
+// save a private or an expiring playground, which is always new
+func (s *storage) apiSaveRandomID(w http.ResponseWriter, r *http.Request, p *page, req *apiRequest, ttl time.Duration) {
+
+	var id, token []byte
+	var err error
+	if req.Private {
+		id, token, err = s.savePrivate(p, req.Password, ttl)
+	} else {
+		id, err = s.saveExpiring(p, ttl)
+	}
+	if err != nil {
+		log.Print(err)
+		writeAPIError(w, err)
+		return
+	}
+
+	resp := apiSaveResponse{
+		ID:  string(id),
+		URL: playgroundURL(r, id),
+	}
+	if req.Private {
+		resp.URL = fmt.Sprintf("%s?%s=%s", resp.URL, tokenParam, token)
+		resp.Token = string(token)
+	}
+	if ttl > 0 {
+		expiresAt := s.expiresAt(id)
+		resp.ExpiresAt = &expiresAt
+	}
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+func allowOnlyPost(w http.ResponseWriter, r *http.Request) bool {
+	return allowOnly(w, r, http.MethodPost)
+}
+
+func allowOnly(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, apiErrorResponse{
+		Kind:    requestError,
+		Message: fmt.Sprintf("method %s is not allowed", r.Method),
+	})
+	return false
+}
+
+func decodeAPIRequest(r *http.Request) (*page, *apiRequest, error) {
+
+	if err := limitBody(r); err != nil {
+		return nil, nil, err
+	}
+
+	var req apiRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, errBodyTooBig) {
+			return nil, nil, err
+		}
+		return nil, nil, newPlaygroundError(requestError, "invalid request body: %v", err)
+	}
+	if req.Mode != bsonLabel && req.Mode != mgodatagenLabel {
+		return nil, nil, newPlaygroundError(requestError, "invalid mode '%s', expecting '%s' or '%s'", req.Mode, bsonLabel, mgodatagenLabel)
+	}
+	if req.Output == "" {
+		req.Output = shellOutput
+	}
+	if !isValidOutput(req.Output) {
+		return nil, nil, &playgroundError{kind: requestError, msg: errInvalidOutput}
+	}
+	p, err := newPage(req.Mode, req.Config, req.Query)
+	return p, &req, err
+}
+
+// absolute url of a saved playground. Unlike the url returned by
+// saveHandler, it doesn't rely on the Referer header
+func playgroundURL(r *http.Request, id []byte) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s%s", scheme, r.Host, viewEndpoint, id)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+
+	var pErr *playgroundError
+	if !errors.As(err, &pErr) {
+		pErr = &playgroundError{msg: err.Error()}
+	}
+
+	if pErr.kind == busyError {
+		w.Header().Set("Retry-After", strconv.Itoa(busyRetryAfter))
+	}
+	writeJSON(w, pErr.statusCode(), apiErrorResponse{
+		Kind:    pErr.kind,
+		Message: pErr.msg,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
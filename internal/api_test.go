@@ -0,0 +1,228 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPIRun(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	apiRunTests := []struct {
+		name         string
+		body         string
+		responseCode int
+		result       string
+		docCount     int
+		errorKind    string
+	}{
+		{
+			name:         "template config",
+			body:         `{"Mode":"bson","Config":"[{\"_id\":1},{\"_id\":2}]","Query":"db.collection.find({\"_id\":2})"}`,
+			responseCode: http.StatusOK,
+			result:       `[{"_id":2}]`,
+			docCount:     1,
+		},
+		{
+			name:         "no document found",
+			body:         `{"Mode":"bson","Config":"[{\"_id\":1}]","Query":"db.collection.find({\"_id\":3})"}`,
+			responseCode: http.StatusOK,
+			result:       `[]`,
+			docCount:     0,
+		},
+		{
+			name:         "invalid json body",
+			body:         `{"Mode":`,
+			responseCode: http.StatusBadRequest,
+			errorKind:    requestError,
+		},
+		{
+			name:         "invalid mode",
+			body:         `{"Mode":"json","Config":"[]","Query":"db.collection.find()"}`,
+			responseCode: http.StatusBadRequest,
+			errorKind:    requestError,
+		},
+		{
+			name:         "invalid config",
+			body:         `{"Mode":"mgodatagen","Config":"h","Query":"db.collection.find()"}`,
+			responseCode: http.StatusBadRequest,
+			errorKind:    configError,
+		},
+		{
+			name:         "invalid query",
+			body:         `{"Mode":"bson","Config":"[{\"_id\":1}]","Query":"find()"}`,
+			responseCode: http.StatusBadRequest,
+			errorKind:    queryError,
+		},
+		{
+			name:         "non existing collection",
+			body:         `{"Mode":"bson","Config":"[{\"_id\":1}]","Query":"db.c.find()"}`,
+			responseCode: http.StatusBadRequest,
+			errorKind:    queryError,
+		},
+		{
+			name:         "execution error",
+			body:         `{"Mode":"bson","Config":"[{\"_id\":1}]","Query":"db.collection.aggregate([1,2])"}`,
+			responseCode: http.StatusUnprocessableEntity,
+			errorKind:    executionError,
+		},
+		{
+			name:         "playground too big",
+			body:         `{"Mode":"bson","Config":"` + strings.Repeat("a", maxByteSize) + `","Query":"db.collection.find()"}`,
+			responseCode: http.StatusRequestEntityTooLarge,
+			errorKind:    limitError,
+		},
+	}
+
+	t.Run("parallel api run", func(t *testing.T) {
+		for _, tt := range apiRunTests {
+
+			test := tt // capture range variable
+			t.Run(test.name, func(t *testing.T) {
+
+				t.Parallel()
+
+				resp := apiResponse(t, apiRunEndpoint, http.MethodPost, test.body)
+				if want, got := test.responseCode, resp.Code; want != got {
+					t.Errorf("expected response code %d but got %d", want, got)
+				}
+
+				if test.errorKind != "" {
+					var errResp apiErrorResponse
+					json.Unmarshal(resp.Body.Bytes(), &errResp)
+					if want, got := test.errorKind, errResp.Kind; want != got {
+						t.Errorf("expected error kind %s but got %s (%s)", want, got, errResp.Message)
+					}
+					return
+				}
+
+				var runResp apiRunResponse
+				if err := json.Unmarshal(resp.Body.Bytes(), &runResp); err != nil {
+					t.Errorf("fail to decode response: %v", err)
+				}
+				if want, got := test.result, runResp.Result; want != got {
+					t.Errorf("expected\n '%s'\n but got\n '%s'", want, got)
+				}
+				if want, got := test.docCount, runResp.Metadata.DocCount; want != got {
+					t.Errorf("expected %d docs but got %d", want, got)
+				}
+				if want, got := "collection", runResp.Metadata.Collection; want != got {
+					t.Errorf("expected collection %s but got %s", want, got)
+				}
+			})
+		}
+	})
+}
+
+func TestAPISave(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	body := `{"Mode":"mgodatagen","Config":` + jsonString(templateConfigOld) + `,"Query":"db.collection.find()"}`
+
+	resp := apiResponse(t, apiSaveEndpoint, http.MethodPost, body)
+	if want, got := http.StatusCreated, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+
+	var saveResp apiSaveResponse
+	json.Unmarshal(resp.Body.Bytes(), &saveResp)
+	if want, got := "http://example.com/"+templateURL, saveResp.URL; want != got {
+		t.Errorf("expected url %s but got %s", want, got)
+	}
+
+	// saving the same playground twice doesn't create a new record
+	resp = apiResponse(t, apiSaveEndpoint, http.MethodPost, body)
+	if want, got := http.StatusOK, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+
+	resp = apiResponse(t, apiSaveEndpoint, http.MethodGet, "")
+	if want, got := http.StatusMethodNotAllowed, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+
+	testStorageContent(t, 0, 1)
+}
+
+func TestAPIRunServerBusy(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	// a limiter with a single slot already in use and no queue
+	limiter := testStorage.runLimiter
+	testStorage.runLimiter = &runLimiter{slots: make(chan struct{}, 1)}
+	testStorage.runLimiter.slots <- struct{}{}
+	defer func() { testStorage.runLimiter = limiter }()
+
+	body := `{"Mode":"bson","Config":"[{\"_id\":1}]","Query":"db.collection.find()"}`
+	resp := apiResponse(t, apiRunEndpoint, http.MethodPost, body)
+
+	if want, got := http.StatusServiceUnavailable, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+	if want, got := strconv.Itoa(busyRetryAfter), resp.Header().Get("Retry-After"); want != got {
+		t.Errorf("expected Retry-After %s but got %s", want, got)
+	}
+	var errResp apiErrorResponse
+	json.Unmarshal(resp.Body.Bytes(), &errResp)
+	if want, got := busyError, errResp.Kind; want != got {
+		t.Errorf("expected error kind %s but got %s", want, got)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+
+	t.Parallel()
+
+	checkServerResponse(t, openAPIEndpoint, http.StatusOK, "application/json; charset=utf-8", gzipEncoding)
+	checkServerResponse(t, openAPIEndpoint, http.StatusOK, "application/json; charset=utf-8", brotliEncoding)
+
+	content, _ := assets.ReadFile(staticDir + "/openapi.json")
+	var spec struct {
+		OpenAPI string
+		Paths   map[string]interface{}
+	}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		t.Errorf("invalid OpenAPI spec: %v", err)
+	}
+	for _, endpoint := range []string{apiRunEndpoint, apiSaveEndpoint, apiSlugEndpoint, runEndpoint, saveEndpoint, healthEndpoint} {
+		if _, ok := spec.Paths[endpoint]; !ok {
+			t.Errorf("endpoint %s is not described in OpenAPI spec", endpoint)
+		}
+	}
+}
+
+func apiResponse(t *testing.T, url, method, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Add("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	testServer.Handler.ServeHTTP(resp, req)
+	return resp
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
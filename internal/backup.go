@@ -24,7 +24,6 @@ import (
 	"log"
 	"os"
 
-	"github.com/dgraph-io/badger/v2"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
@@ -38,14 +37,14 @@ const (
 	tokenFile = "token.json"
 )
 
-func localBackup(storage *badger.DB, fileName string) error {
+func localBackup(store playgroundStore, fileName string) error {
 	f, err := os.Create(fileName)
 	if err != nil {
 		return fmt.Errorf("fail to create file %s: %v", fileName, err)
 	}
 	defer f.Close()
 
-	_, err = storage.Backup(f, 1)
+	err = store.backup(f)
 	if err != nil {
 		return fmt.Errorf("backup failed: %v", err)
 	}
@@ -0,0 +1,411 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+const (
+	// badger caches decrypted blocks, so they are not decrypted on each read
+	encryptedBlockCacheSize = 64 << 20
+	// name of the export of a plaintext store, kept in the store
+	// dir until the store is encrypted
+	plaintextExportName = "plaintext_export.bak"
+	// encrypted backups are split in chunks of this size,
+	// each one sealed with AES-GCM
+	backupChunkSize = 64 * 1024
+	// chunk nonces are made of a random prefix of this size,
+	// followed by the chunk index
+	backupNoncePrefixSize = 8
+	// backups start with the fingerprint of the key
+	// they were encrypted with
+	keyFingerprintSize = 8
+)
+
+var (
+	encryptedBackupMagic = []byte("mpenc1")
+
+	errInvalidBackup   = errors.New("invalid or corrupted encrypted backup")
+	errTruncatedBackup = errors.New("encrypted backup is truncated")
+)
+
+// decode a hex encoded encryption key. An empty string
+// means no encryption
+func parseEncryptionKey(hexKey string) ([]byte, error) {
+	hexKey = strings.TrimSpace(hexKey)
+	if hexKey == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not hex encoded: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes long, got %d", len(key))
+}
+
+func badgerOptions(dir string, key []byte) badger.Options {
+	opts := badger.DefaultOptions(dir)
+	if len(key) > 0 {
+		opts = opts.WithEncryptionKey(key).WithBlockCacheSize(encryptedBlockCacheSize)
+	}
+	return opts
+}
+
+// open the badger db in dir with key. If the store was encrypted with
+// previousKey, the key is rotated first. If the store is not encrypted yet
+// and no previousKey is given, it's migrated to an encrypted store
+func openBadger(dir string, key, previousKey []byte) (*badger.DB, error) {
+
+	// a previous migration was interrupted
+	if _, err := os.Stat(filepath.Join(dir, plaintextExportName)); err == nil {
+		if err := importPlaintextExport(dir, key); err != nil {
+			return nil, fmt.Errorf("fail to encrypt badger store: %v", err)
+		}
+	}
+
+	db, err := badger.Open(badgerOptions(dir, key))
+	if !errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return db, err
+	}
+
+	switch {
+	case len(previousKey) > 0:
+		log.Print("rotating badger encryption key")
+		err = rotateEncryptionKey(dir, previousKey, key)
+	case len(key) > 0:
+		log.Print("encrypting badger store")
+		err = encryptBadgerDir(dir, key)
+	default:
+		return nil, errors.New("badger store is encrypted, but no encryption key is configured")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to change badger encryption key: %v", err)
+	}
+	return badger.Open(badgerOptions(dir, key))
+}
+
+// rotateEncryptionKey re-encrypts the data keys of the store, stored in
+// its key registry, with the new key. The data itself is encrypted by
+// the data keys, so it doesn't have to be rewritten
+func rotateEncryptionKey(dir string, previousKey, key []byte) error {
+
+	opts := badger.KeyRegistryOptions{
+		Dir:                           dir,
+		ReadOnly:                      true,
+		EncryptionKey:                 previousKey,
+		EncryptionKeyRotationDuration: badger.DefaultOptions(dir).EncryptionKeyRotationDuration,
+	}
+	registry, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return err
+	}
+	opts.EncryptionKey = key
+	return badger.WriteKeyRegistry(registry, opts)
+}
+
+// encryptBadgerDir migrates a plaintext store to an encrypted one. The
+// content of the store is exported in its dir, the plaintext files are
+// removed, and the export is loaded in a new encrypted store. The dir
+// itself is kept, as it may be a mounted volume
+func encryptBadgerDir(dir string, key []byte) error {
+
+	plain, err := badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		return err
+	}
+
+	// write the export to a temporary file first, so a partial
+	// export is never mistaken for a complete one
+	tmpName := filepath.Join(dir, plaintextExportName+".tmp")
+	f, err := os.Create(tmpName)
+	if err != nil {
+		plain.Close()
+		return err
+	}
+	_, err = plain.Backup(f, 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := plain.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, plaintextExportName)); err != nil {
+		return err
+	}
+	return importPlaintextExport(dir, key)
+}
+
+// importPlaintextExport replaces the content of dir with an encrypted
+// store holding the playgrounds of the plaintext export
+func importPlaintextExport(dir string, key []byte) error {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == plaintextExportName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	exportName := filepath.Join(dir, plaintextExportName)
+	f, err := os.Open(exportName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := badger.Open(badgerOptions(dir, key))
+	if err != nil {
+		return err
+	}
+	err = db.Load(f, 16)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(exportName)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// identifies the key a backup was encrypted with,
+// without disclosing it
+func keyFingerprint(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyFingerprintSize]
+}
+
+// encryptedWriter encrypts a backup. Each chunk is written as its size
+// followed by the sealed chunk. The last chunk is sealed with a different
+// additional data, so a truncated backup can't be restored
+type encryptedWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	index uint32
+	buf   []byte
+}
+
+func newEncryptedWriter(w io.Writer, key []byte) (*encryptedWriter, error) {
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce[:backupNoncePrefixSize]); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(encryptedBackupMagic)+keyFingerprintSize+backupNoncePrefixSize)
+	header = append(header, encryptedBackupMagic...)
+	header = append(header, keyFingerprint(key)...)
+	header = append(header, nonce[:backupNoncePrefixSize]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+		buf:   make([]byte, 0, backupChunkSize),
+	}, nil
+}
+
+func (e *encryptedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// only seal a full chunk once more data comes,
+		// as the last chunk is sealed by Close()
+		if len(e.buf) == backupChunkSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		size := backupChunkSize - len(e.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		e.buf = append(e.buf, p[:size]...)
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Close seals the last chunk. It doesn't close the underlying writer
+func (e *encryptedWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptedWriter) seal(last bool) error {
+
+	binary.BigEndian.PutUint32(e.nonce[backupNoncePrefixSize:], e.index)
+	e.index++
+
+	sealed := e.aead.Seal(nil, e.nonce, e.buf, chunkAdditionalData(last))
+	e.buf = e.buf[:0]
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(sealed)))
+	if _, err := e.w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// decryptedReader reads a backup written by encryptedWriter
+type decryptedReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint32
+	buf   []byte
+	last  bool
+}
+
+// newBackupReader returns a reader over the plaintext content of the
+// backup. Encrypted backups are decrypted with the key they were
+// encrypted with, among keys. Plaintext backups are read as is
+func newBackupReader(r io.Reader, keys ...[]byte) (io.Reader, error) {
+
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encryptedBackupMagic))
+	if err != nil || !bytes.Equal(magic, encryptedBackupMagic) {
+		return br, nil
+	}
+
+	header := make([]byte, len(encryptedBackupMagic)+keyFingerprintSize+backupNoncePrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errInvalidBackup
+	}
+	fingerprint := header[len(encryptedBackupMagic) : len(encryptedBackupMagic)+keyFingerprintSize]
+
+	for _, key := range keys {
+		if len(key) == 0 || !bytes.Equal(keyFingerprint(key), fingerprint) {
+			continue
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		copy(nonce, header[len(header)-backupNoncePrefixSize:])
+		return &decryptedReader{
+			r:     br,
+			aead:  aead,
+			nonce: nonce,
+		}, nil
+	}
+	return nil, errors.New("backup is encrypted with an unknown key")
+}
+
+func (d *decryptedReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptedReader) open() error {
+
+	var size [4]byte
+	if _, err := io.ReadFull(d.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errTruncatedBackup
+		}
+		return err
+	}
+	sealedSize := binary.BigEndian.Uint32(size[:])
+	if sealedSize > backupChunkSize+uint32(d.aead.Overhead()) {
+		return errInvalidBackup
+	}
+	sealed := make([]byte, sealedSize)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errTruncatedBackup
+		}
+		return err
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[backupNoncePrefixSize:], d.index)
+	d.index++
+
+	chunk, err := d.aead.Open(nil, d.nonce, sealed, chunkAdditionalData(false))
+	if err != nil {
+		chunk, err = d.aead.Open(nil, d.nonce, sealed, chunkAdditionalData(true))
+		if err != nil {
+			return errInvalidBackup
+		}
+		d.last = true
+	}
+	d.buf = chunk
+	return nil
+}
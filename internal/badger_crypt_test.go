@@ -0,0 +1,194 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+
+	t.Parallel()
+
+	parseTests := []struct {
+		name    string
+		hexKey  string
+		keySize int
+		valid   bool
+	}{
+		{name: "no key", hexKey: "", keySize: 0, valid: true},
+		{name: "AES-128", hexKey: "000102030405060708090a0b0c0d0e0f", keySize: 16, valid: true},
+		{name: "AES-256 with trailing newline", hexKey: "000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f\n", keySize: 32, valid: true},
+		{name: "invalid size", hexKey: "0001", valid: false},
+		{name: "not hex", hexKey: "not an hex encoded key, really no", valid: false},
+	}
+
+	for _, tt := range parseTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			t.Parallel()
+
+			key, err := parseEncryptionKey(test.hexKey)
+			if want, got := test.valid, err == nil; want != got {
+				t.Errorf("expected valid key to be %v but got %v: %v", want, got, err)
+			}
+			if want, got := test.keySize, len(key); want != got {
+				t.Errorf("expected key of %d bytes but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+
+	t.Parallel()
+
+	key, otherKey := newTestKey(), newTestKey()
+
+	for _, size := range []int{0, 10, backupChunkSize, 3*backupChunkSize + 7} {
+
+		content := make([]byte, size)
+		rand.Read(content)
+
+		var backup bytes.Buffer
+		ew, _ := newEncryptedWriter(&backup, key)
+		ew.Write(content)
+		ew.Close()
+
+		if bytes.Contains(backup.Bytes(), content) && size > 0 {
+			t.Errorf("backup of %d bytes should be encrypted", size)
+		}
+
+		r, err := newBackupReader(bytes.NewReader(backup.Bytes()), otherKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(content, got) {
+			t.Errorf("fail to decrypt backup of %d bytes: %v", size, err)
+		}
+
+		// the last chunk is missing
+		if size > backupChunkSize {
+			r, _ = newBackupReader(bytes.NewReader(backup.Bytes()[:backup.Len()-100]), key)
+			if _, err := io.ReadAll(r); !errors.Is(err, errTruncatedBackup) {
+				t.Errorf("expected error %v but got %v", errTruncatedBackup, err)
+			}
+		}
+	}
+
+	var backup bytes.Buffer
+	ew, _ := newEncryptedWriter(&backup, key)
+	ew.Close()
+	if _, err := newBackupReader(&backup, otherKey); err == nil {
+		t.Errorf("backup should not be readable with another key")
+	}
+
+	// plaintext backups are read as is
+	r, _ := newBackupReader(bytes.NewReader([]byte("plaintext")), key)
+	if got, _ := io.ReadAll(r); string(got) != "plaintext" {
+		t.Errorf("expected plaintext but got %s", got)
+	}
+}
+
+func TestBadgerEncryption(t *testing.T) {
+
+	t.Parallel()
+
+	dir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(dir)
+
+	key, newKey := newTestKey(), newTestKey()
+
+	store, err := newBadgerStore(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.putIfAbsent([]byte("a"), []byte("1"))
+	var plaintextBackup bytes.Buffer
+	store.backup(&plaintextBackup)
+	store.close()
+
+	// the plaintext store is migrated
+	store, err = newBadgerStore(dir, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoredValue(t, store, "a", "1")
+	store.putIfAbsent([]byte("b"), []byte("2"))
+	var backup bytes.Buffer
+	store.backup(&backup)
+	store.close()
+
+	if _, err := os.Stat(dir + "/" + plaintextExportName); !os.IsNotExist(err) {
+		t.Errorf("plaintext export should have been removed")
+	}
+	if _, err := newBadgerStore(dir, nil, nil); err == nil {
+		t.Errorf("encrypted store should not be opened without key")
+	}
+
+	// rotate the key
+	store, err = newBadgerStore(dir, newKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.close()
+	if _, err := newBadgerStore(dir, key, nil); err == nil {
+		t.Errorf("store should not be opened with the previous key once rotated")
+	}
+	store, err = newBadgerStore(dir, newKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	testStoredValue(t, store, "b", "2")
+
+	// backups made before the rotation or the migration can be restored
+	restoreDir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(restoreDir)
+
+	restored, _ := newBadgerStore(restoreDir, newKey, key)
+	defer restored.close()
+	if err := restored.restore(&plaintextBackup); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	testStoredValue(t, restored, "a", "1")
+	testStoredValue(t, restored, "b", "2")
+}
+
+func testStoredValue(t *testing.T, store playgroundStore, id, want string) {
+	got, err := store.get([]byte(id))
+	if err != nil || want != string(got) {
+		t.Errorf("expected %s but got %s, %v", want, got, err)
+	}
+}
+
+func newTestKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
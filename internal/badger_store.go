@@ -0,0 +1,268 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+const (
+	// default interval between two garbage collections of the value log
+	defaultValueLogGCInterval = 10 * time.Minute
+	// a value log file is rewritten if at least half of its
+	// content can be discarded
+	valueLogGCDiscardRatio = 0.5
+	// badger is reported as degraded when the disk holding
+	// it has less than 10% of free space
+	defaultMinFreeDiskRatio = 0.1
+)
+
+// badgerStore keeps the playgrounds in a local badger database
+type badgerStore struct {
+	db  *badger.DB
+	dir string
+	// ratio of free disk space under which
+	// the store is reported as degraded
+	minFreeDiskRatio float64
+	// key encrypting the store and its backups, if any. Backups
+	// made before the last rotation use previousKey
+	key         []byte
+	previousKey []byte
+}
+
+// open the badger store in dir. If key is not empty, the store is
+// encrypted, see openBadger()
+func newBadgerStore(dir string, key, previousKey []byte) (*badgerStore, error) {
+	db, err := openBadger(dir, key, previousKey)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerStore{
+		db:               db,
+		dir:              dir,
+		minFreeDiskRatio: defaultMinFreeDiskRatio,
+		key:              key,
+		previousKey:      previousKey,
+	}, nil
+}
+
+// runValueLogGC rewrites value log files until no more space can be
+// reclaimed. Deleted or overwritten values are only removed from disk
+// once their value log file is rewritten
+func (b *badgerStore) runValueLogGC() {
+
+	rewritten := 0
+	var err error
+	for err == nil {
+		err = b.db.RunValueLogGC(valueLogGCDiscardRatio)
+		if err == nil {
+			rewritten++
+		}
+	}
+	if !errors.Is(err, badger.ErrNoRewrite) {
+		log.Printf("badger value log GC failed: %v", err)
+	}
+
+	badgerGCRewrittenFiles.Set(float64(rewritten))
+	badgerGCLastRun.SetToCurrentTime()
+	b.updateSizeMetrics()
+}
+
+func (b *badgerStore) updateSizeMetrics() {
+	lsm, vlog := b.db.Size()
+	badgerLSMSize.Set(float64(lsm))
+	badgerValueLogSize.Set(float64(vlog))
+}
+
+func (b *badgerStore) get(id []byte) (val []byte, err error) {
+	err = b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(id)
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, errPlaygroundNotFound
+	}
+	return val, err
+}
+
+func (b *badgerStore) putIfAbsent(id, val []byte) (inserted bool, err error) {
+	return b.putIfAbsentWithTTL(id, val, 0)
+}
+
+func (b *badgerStore) putIfAbsentWithTTL(id, val []byte, ttl time.Duration) (inserted bool, err error) {
+	err = b.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(id)
+		// if the key is not found, an 'ErrKeyNotFound' is returned.
+		// hence if the error is nil, the playground is already saved
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+		inserted = true
+		entry := badger.NewEntry(id, val)
+		if ttl > 0 {
+			entry = entry.WithTTL(ttl)
+		}
+		return txn.SetEntry(entry)
+	})
+	// two concurrent saves of the same playground conflict, one
+	// of them has already saved it
+	if errors.Is(err, badger.ErrConflict) {
+		return false, nil
+	}
+	return inserted && err == nil, err
+}
+
+func (b *badgerStore) update(id []byte, fn func(old []byte) ([]byte, error)) error {
+	for {
+		err := b.db.Update(func(txn *badger.Txn) error {
+			var old []byte
+			var expiresAt uint64
+			item, err := txn.Get(id)
+			if err == nil {
+				expiresAt = item.ExpiresAt()
+				old, err = item.ValueCopy(nil)
+			}
+			if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+				return err
+			}
+			val, err := fn(old)
+			if err != nil {
+				return err
+			}
+			if val == nil {
+				return txn.Delete(id)
+			}
+			entry := badger.NewEntry(id, val)
+			entry.ExpiresAt = expiresAt
+			return txn.SetEntry(entry)
+		})
+		// the id has been updated by a concurrent transaction,
+		// so try again with the new value
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+}
+
+func (b *badgerStore) delete(id []byte) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(id)
+	})
+}
+
+func (b *badgerStore) iterate(fn func(id, val []byte) error) error {
+	return b.iteratePrefix(nil, false, fn)
+}
+
+func (b *badgerStore) iteratePrefix(prefix []byte, reverse bool, fn func(id, val []byte) error) error {
+	err := b.db.View(func(txn *badger.Txn) error {
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.Reverse = reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// in reverse order, seek to the last key having the prefix
+		start := prefix
+		if reverse {
+			start = append(append([]byte(nil), prefix...), 0xFF)
+		}
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				return fn(item.Key(), val)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
+
+// backup in badger format, can be restored with restore(). If the store
+// is encrypted, the backup is encrypted with the same key
+func (b *badgerStore) backup(w io.Writer) error {
+	if len(b.key) == 0 {
+		_, err := b.db.Backup(w, 1)
+		return err
+	}
+
+	ew, err := newEncryptedWriter(w, b.key)
+	if err != nil {
+		return err
+	}
+	if _, err := b.db.Backup(ew, 1); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// restore loads the playgrounds of a backup made by backup(). The backup
+// can be plaintext, or encrypted with the current or the previous key
+func (b *badgerStore) restore(r io.Reader) error {
+	br, err := newBackupReader(r, b.key, b.previousKey)
+	if err != nil {
+		return err
+	}
+	return b.db.Load(br, 16)
+}
+
+func (b *badgerStore) health() serviceInfo {
+	info := serviceInfo{
+		Name:   badgerStoreName,
+		Status: statusUp,
+	}
+	if b.db.IsClosed() {
+		info.Status = statusDown
+		info.Cause = "database is closed"
+		return info
+	}
+
+	free, total, err := diskSpace(b.dir)
+	if err != nil {
+		log.Printf("fail to get free disk space: %v", err)
+		return info
+	}
+	if float64(free) < b.minFreeDiskRatio*float64(total) {
+		info.Status = statusDegrade
+		info.Cause = fmt.Sprintf("low disk space: %d MB free out of %d MB", free/1e6, total/1e6)
+	}
+	return info
+}
+
+func (b *badgerStore) close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,163 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// default max size in bytes of the results kept in cache
+const defaultResultCacheSize = 64 * 1000 * 1000
+
+// operators and variables that can make the output of a read-only
+// query change from one run to another
+var nonDeterministicOperators = [][]byte{
+	[]byte("$rand"),
+	[]byte("$sample"),
+	[]byte("$$NOW"),
+	[]byte("$$CLUSTER_TIME"),
+	[]byte("$currentDate"),
+}
+
+// resultCache is a LRU cache holding the results of read-only queries.
+// Its size is bounded by the total size of the cached documents
+type resultCache struct {
+	// lock guards all fields below
+	lock    sync.Mutex
+	maxSize int
+	size    int
+	// most recently used entries are at the front of the list
+	entries *list.List
+	index   map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key    string
+	result *runResult
+	size   int
+}
+
+// create a new cache. If maxSize is negative, the cache is
+// disabled and never stores anything
+func newResultCache(maxSize int) *resultCache {
+	if maxSize == 0 {
+		maxSize = defaultResultCacheSize
+	}
+	return &resultCache{
+		maxSize: maxSize,
+		entries: list.New(),
+		index:   map[string]*list.Element{},
+	}
+}
+
+// key of the result of a page. The same playground can give a different
+// result with another version of MongoDB. Unlike the id of the page, the
+// key is the full sha256 of the page, so two pages can't share a result
+func resultCacheKey(p *page, mongoVersion []byte) string {
+	e := sha256.New()
+	e.Write([]byte{p.Mode})
+	// the length of the query is hashed too, so the boundary
+	// between the query and the configuration is part of the key
+	binary.Write(e, binary.LittleEndian, uint32(len(p.Query)))
+	e.Write(p.Query)
+	e.Write(p.Config)
+	return string(e.Sum(nil)) + "_" + string(mongoVersion)
+}
+
+// returns true if the result of the page can be cached
+func isCacheable(p *page, method string) bool {
+	if isWriteMethod(method) {
+		return false
+	}
+	for _, op := range nonDeterministicOperators {
+		if bytes.Contains(p.Query, op) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *resultCache) get(key string) (*runResult, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.index[key]
+	if !ok {
+		resultCacheMisses.Inc()
+		return nil, false
+	}
+	resultCacheHits.Inc()
+	c.entries.MoveToFront(elem)
+
+	// return a copy, so the caller can't modify the cached result
+	res := *elem.Value.(*cacheEntry).result
+	res.cached = true
+	return &res, true
+}
+
+func (c *resultCache) add(key string, res *runResult) {
+
+	size := len(key)
+	for _, doc := range res.docs {
+		size += len(doc)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if size > c.maxSize {
+		return
+	}
+	if elem, ok := c.index[key]; ok {
+		c.removeElement(elem)
+	}
+
+	c.index[key] = c.entries.PushFront(&cacheEntry{
+		key:    key,
+		result: res,
+		size:   size,
+	})
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.entries.Back())
+	}
+	resultCacheSize.Set(float64(c.size))
+}
+
+// remove all entries from the cache
+func (c *resultCache) purge() {
+	c.lock.Lock()
+	c.entries.Init()
+	c.index = map[string]*list.Element{}
+	c.size = 0
+	c.lock.Unlock()
+
+	resultCacheSize.Set(0)
+}
+
+// caller must hold the lock
+func (c *resultCache) removeElement(elem *list.Element) {
+	entry := c.entries.Remove(elem).(*cacheEntry)
+	delete(c.index, entry.key)
+	c.size -= entry.size
+}
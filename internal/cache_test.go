@@ -0,0 +1,89 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestResultCacheEviction(t *testing.T) {
+
+	t.Parallel()
+
+	doc, _ := bson.Marshal(bson.M{"_id": 1})
+	res := &runResult{docs: []bson.Raw{doc}}
+	entrySize := len("a") + len(doc)
+
+	cache := newResultCache(3 * entrySize)
+	cache.add("a", res)
+	cache.add("b", res)
+	cache.add("c", res)
+
+	// "a" becomes the most recently used entry, so
+	// "b" is evicted when "d" is added
+	if _, ok := cache.get("a"); !ok {
+		t.Errorf("'a' should be in cache")
+	}
+	cache.add("d", res)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, got := cache.get(key); want != got {
+			t.Errorf("expected '%s' in cache to be %v but got %v", key, want, got)
+		}
+	}
+	if want, got := 3*entrySize, cache.size; want != got {
+		t.Errorf("expected cache size %d but got %d", want, got)
+	}
+
+	cache.purge()
+	if _, ok := cache.get("a"); ok {
+		t.Errorf("cache should be empty after purge")
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+
+	t.Parallel()
+
+	cache := newResultCache(-1)
+	cache.add("a", &runResult{})
+
+	if _, ok := cache.get("a"); ok {
+		t.Errorf("disabled cache should not store anything")
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+
+	t.Parallel()
+
+	p := &page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte("db.collection.find()")}
+	// same content, but with a different boundary between the query and the config
+	shifted := &page{Mode: bsonMode, Config: []byte(`)[{"_id":1}]`), Query: []byte("db.collection.find(")}
+
+	if resultCacheKey(p, []byte("5.0.5")) != resultCacheKey(&page{Mode: p.Mode, Config: p.Config, Query: p.Query}, []byte("5.0.5")) {
+		t.Errorf("identical pages should have the same key")
+	}
+	if resultCacheKey(p, []byte("5.0.5")) == resultCacheKey(shifted, []byte("5.0.5")) {
+		t.Errorf("pages with a different query should have different keys")
+	}
+	if resultCacheKey(p, []byte("5.0.5")) == resultCacheKey(p, []byte("4.4.0")) {
+		t.Errorf("results of different versions should have different keys")
+	}
+}
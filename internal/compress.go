@@ -0,0 +1,195 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Pages and configuration blobs of the playground store are compressed if
+// they're at least minCompressedSize bytes. Other values, like access
+// records, are never compressed, as they may start with any bytes. A
+// compressed value is encoded as:
+//
+// v[0:4] -> compressedTag. Pages and configuration blobs can't start with
+// these bytes, see page.encode() and decodeConfigBlob(), so compressed and
+// uncompressed values can be told apart
+// v[4] -> the compression algorithm
+// v[5:] -> the compressed value
+const (
+	minCompressedSize = 1024
+	// values compressed with brotli
+	brotliCompression byte = 1
+	// key saved once the values saved before compression was
+	// introduced are compressed, so they're compressed only once
+	legacyValuesCompressedKey = "migrations/compressed"
+)
+
+var compressedTag = []byte{0xff, 0xff, 0xff, 0xff}
+
+// compressedStore compresses the values saved in the underlying store,
+// and transparently decompresses them, even if they were saved before
+// compression was introduced. Backups hold the compressed values
+type compressedStore struct {
+	playgroundStore
+}
+
+func (c *compressedStore) get(id []byte) ([]byte, error) {
+	val, err := c.playgroundStore.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return decompressValue(id, val)
+}
+
+func (c *compressedStore) putIfAbsent(id, val []byte) (bool, error) {
+	return c.playgroundStore.putIfAbsent(id, compressAndObserve(id, val))
+}
+
+func (c *compressedStore) putIfAbsentWithTTL(id, val []byte, ttl time.Duration) (bool, error) {
+	return c.playgroundStore.putIfAbsentWithTTL(id, compressAndObserve(id, val), ttl)
+}
+
+func (c *compressedStore) update(id []byte, fn func(old []byte) ([]byte, error)) error {
+	return c.playgroundStore.update(id, func(old []byte) ([]byte, error) {
+		if old != nil {
+			var err error
+			if old, err = decompressValue(id, old); err != nil {
+				return nil, err
+			}
+		}
+		val, err := fn(old)
+		if err != nil || val == nil {
+			return nil, err
+		}
+		return compressAndObserve(id, val), nil
+	})
+}
+
+func (c *compressedStore) iterate(fn func(id, val []byte) error) error {
+	return c.playgroundStore.iterate(func(id, val []byte) error {
+		val, err := decompressValue(id, val)
+		if err != nil {
+			return fmt.Errorf("fail to decompress %s: %v", id, err)
+		}
+		return fn(id, val)
+	})
+}
+
+func (c *compressedStore) iteratePrefix(prefix []byte, reverse bool, fn func(id, val []byte) error) error {
+	return c.playgroundStore.iteratePrefix(prefix, reverse, func(id, val []byte) error {
+		val, err := decompressValue(id, val)
+		if err != nil {
+			return fmt.Errorf("fail to decompress %s: %v", id, err)
+		}
+		return fn(id, val)
+	})
+}
+
+// compress the values saved before compression was introduced, and
+// return the number of values compressed. Once done, it's never run again
+func (c *compressedStore) compressLegacyValues() (int, error) {
+
+	if _, err := c.playgroundStore.get([]byte(legacyValuesCompressedKey)); err == nil {
+		return 0, nil
+	}
+
+	ids := make([][]byte, 0)
+	err := c.playgroundStore.iterate(func(id, val []byte) error {
+		if isCompressible(id) && !bytes.HasPrefix(val, compressedTag) && len(compressValue(val)) < len(val) {
+			ids = append(ids, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, id := range ids {
+		// the value is compressed when it's written back
+		err := c.update(id, func(old []byte) ([]byte, error) {
+			return old, nil
+		})
+		if err != nil {
+			return i, fmt.Errorf("fail to compress %s: %v", id, err)
+		}
+	}
+
+	done := []byte(time.Now().UTC().Format(time.RFC3339))
+	if _, err := c.playgroundStore.putIfAbsent([]byte(legacyValuesCompressedKey), done); err != nil {
+		return len(ids), fmt.Errorf("fail to save end of compression: %v", err)
+	}
+	return len(ids), nil
+}
+
+// returns true if the value saved with this key can be compressed,
+// ie if it's a page or a configuration blob
+func isCompressible(id []byte) bool {
+	return isPageKey(id) || isConfigBlobKey(id)
+}
+
+// compress the value if it's big enough. If the compressed value
+// isn't smaller, the value is returned as is
+func compressValue(v []byte) []byte {
+
+	if len(v) < minCompressedSize {
+		return v
+	}
+
+	var buf bytes.Buffer
+	buf.Write(compressedTag)
+	buf.WriteByte(brotliCompression)
+
+	w := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	w.Write(v)
+	w.Close()
+
+	if buf.Len() >= len(v) {
+		return v
+	}
+	return buf.Bytes()
+}
+
+// compress the value if it can be compressed, and record the compression ratio
+func compressAndObserve(id, v []byte) []byte {
+	if !isCompressible(id) {
+		return v
+	}
+	compressed := compressValue(v)
+	if len(compressed) < len(v) {
+		storedValueCompressionRatio.Observe(float64(len(v)) / float64(len(compressed)))
+	}
+	return compressed
+}
+
+// return the decompressed value, or the value itself if
+// it's not compressed
+func decompressValue(id, v []byte) ([]byte, error) {
+
+	if !isCompressible(id) || !bytes.HasPrefix(v, compressedTag) {
+		return v, nil
+	}
+	if len(v) < 5 || v[4] != brotliCompression {
+		return nil, fmt.Errorf("unknown compression algorithm")
+	}
+	return io.ReadAll(brotli.NewReader(bytes.NewReader(v[5:])))
+}
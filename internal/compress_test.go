@@ -0,0 +1,117 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStore(t *testing.T) {
+
+	t.Parallel()
+
+	raw := newMemoryStore()
+	store := &compressedStore{raw}
+
+	p, _ := newPage(bsonLabel, "["+strings.Repeat(`{"k": "value"},`, 100)+"]", "db.collection.find()")
+	small, _ := newPage(bsonLabel, "[{}]", "db.collection.find()")
+
+	for _, val := range [][]byte{p.encode(), small.encode()} {
+		store.putIfAbsent(val[5:16], val)
+
+		got, err := store.get(val[5:16])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, got) {
+			t.Errorf("expected %s but got %s", val, got)
+		}
+	}
+
+	stored, _ := raw.get(p.encode()[5:16])
+	if !bytes.HasPrefix(stored, compressedTag) || len(stored) >= len(p.encode()) {
+		t.Errorf("big values should be compressed, got %d bytes", len(stored))
+	}
+	stored, _ = raw.get(small.encode()[5:16])
+	if !bytes.Equal(small.encode(), stored) {
+		t.Errorf("small values should not be compressed, got %v", stored)
+	}
+}
+
+func TestCompressOnlyPages(t *testing.T) {
+
+	t.Parallel()
+
+	raw := newMemoryStore()
+	store := &compressedStore{raw}
+
+	// an access record starting like a compressed value
+	id := []byte(accessPrefix + "nJhd-dhf3Ea")
+	access := append(append([]byte(nil), compressedTag...), bytes.Repeat([]byte("a"), minCompressedSize)...)
+	store.putIfAbsent(id, access)
+
+	if stored, _ := raw.get(id); !bytes.Equal(access, stored) {
+		t.Errorf("access records should not be compressed")
+	}
+	if got, err := store.get(id); err != nil || !bytes.Equal(access, got) {
+		t.Errorf("expected %d bytes but got %d bytes, %v", len(access), len(got), err)
+	}
+}
+
+func TestCompressLegacyValues(t *testing.T) {
+
+	t.Parallel()
+
+	raw := newMemoryStore()
+	store := &compressedStore{raw}
+
+	big := []byte(strings.Repeat("db.collection.find()", 100))
+	random := make([]byte, minCompressedSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	raw.putIfAbsent([]byte("bigPage0000"), big)
+	raw.putIfAbsent([]byte("randomPage0"), random)
+	raw.putIfAbsent([]byte("smallPage00"), []byte("db.collection.find()"))
+	// only pages and configuration blobs are compressed
+	raw.putIfAbsent([]byte(accessPrefix+"bigPage0000"), big)
+
+	compressed, err := store.compressLegacyValues()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, compressed; want != got {
+		t.Errorf("expected %d compressed values but got %d", want, got)
+	}
+	// the migration is only run once
+	raw.putIfAbsent([]byte("otherPage00"), big)
+	if compressed, _ = store.compressLegacyValues(); compressed != 0 {
+		t.Errorf("values should be compressed only once, but got %d compressed values", compressed)
+	}
+
+	stored, _ := raw.get([]byte("bigPage0000"))
+	if !bytes.HasPrefix(stored, compressedTag) {
+		t.Errorf("legacy value should be compressed")
+	}
+	store.iterate(func(id, val []byte) error {
+		if string(id) == "bigPage0000" && !bytes.Equal(big, val) {
+			t.Errorf("expected %s but got %s", big, val)
+		}
+		return nil
+	})
+}
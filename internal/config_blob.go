@@ -0,0 +1,211 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// Many saved playgrounds share the same configuration and only differ by
+// their query. Configurations of at least minConfigBlobSize bytes are saved
+// once, in a blob identified by their sha256, and pages only keep a reference
+// to this blob. A blob is encoded as:
+//
+// v[0:4] -> an uint32, the number of pages referencing this blob
+// v[4:] -> the configuration
+//
+// and is deleted when it's not referenced anymore
+const (
+	// smaller configurations are kept in the page, as the blob
+	// key and the reference would take more room than they save
+	minConfigBlobSize = 512
+	// length of the sha256 referencing a blob
+	configRefLength = sha256.Size
+	// prefix of the keys of the blobs in the playground store
+	configBlobPrefix = "config/"
+
+	// where the configuration of a saved page is, reported as the
+	// 'config' label of saved_playground_size: in the page, in a blob
+	// saved with the page, or in a blob shared with other pages. The
+	// size of pages with a deduplicated configuration is what blobs save
+	inlineConfig       = "inline"
+	blobConfig         = "blob"
+	deduplicatedConfig = "deduplicated"
+)
+
+// returns the key of the blob in the playground store
+func configBlobKey(ref []byte) []byte {
+	return []byte(configBlobPrefix + hex.EncodeToString(ref))
+}
+
+// returns true if the key of the playground store is a
+// configuration blob and not a page
+func isConfigBlobKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(configBlobPrefix))
+}
+
+// returns the number of references and the configuration of a blob
+func decodeConfigBlob(v []byte) (refs uint32, config []byte) {
+	return binary.LittleEndian.Uint32(v[0:4]), v[4:]
+}
+
+// encode the page, saving its configuration in a blob if it's big enough,
+// and return where its configuration is. The reference to the blob must
+// be released if the page isn't saved
+func (s *storage) encodePage(p *page) (val, ref []byte, configStorage string, err error) {
+	if len(p.Config) < minConfigBlobSize {
+		return p.encode(), nil, inlineConfig, nil
+	}
+	ref, shared, err := s.acquireConfigBlob(p.Config)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	configStorage = blobConfig
+	if shared {
+		configStorage = deduplicatedConfig
+	}
+	return p.encodeWithConfigRef(ref), ref, configStorage, nil
+}
+
+// save the configuration in a blob, or add a reference to the blob
+// if it's already saved, and return the ref of the blob. shared is
+// true if the blob was already saved
+func (s *storage) acquireConfigBlob(config []byte) (ref []byte, shared bool, err error) {
+
+	sum := sha256.Sum256(config)
+	ref = sum[:]
+
+	err = s.store.update(configBlobKey(ref), func(old []byte) ([]byte, error) {
+		shared = old != nil
+		if !shared {
+			v := make([]byte, 4+len(config))
+			binary.LittleEndian.PutUint32(v[0:4], 1)
+			copy(v[4:], config)
+			return v, nil
+		}
+		refs, _ := decodeConfigBlob(old)
+		v := append([]byte(nil), old...)
+		binary.LittleEndian.PutUint32(v[0:4], refs+1)
+		return v, nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("fail to save configuration blob: %v", err)
+	}
+	return ref, shared, nil
+}
+
+// remove a reference to the blob, and delete it if it was the last one
+func (s *storage) releaseConfigBlob(ref []byte) error {
+
+	err := s.store.update(configBlobKey(ref), func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, nil
+		}
+		refs, _ := decodeConfigBlob(old)
+		if refs <= 1 {
+			return nil, nil
+		}
+		v := append([]byte(nil), old...)
+		binary.LittleEndian.PutUint32(v[0:4], refs-1)
+		return v, nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail to release configuration blob: %v", err)
+	}
+	return nil
+}
+
+func (s *storage) loadConfigBlob(ref []byte) ([]byte, error) {
+	val, err := s.store.get(configBlobKey(ref))
+	if err != nil {
+		return nil, fmt.Errorf("fail to load configuration blob: %v", err)
+	}
+	_, config := decodeConfigBlob(val)
+	return config, nil
+}
+
+// move the configurations of the pages saved before configuration blobs
+// existed to blobs, and return the number of pages migrated
+func (s *storage) migrateConfigBlobs() (int, error) {
+
+	ids := make([][]byte, 0)
+	err := s.store.iterate(func(id, val []byte) error {
+		if !isPageKey(id) || configRef(val) != nil {
+			return nil
+		}
+		p := &page{}
+		p.decode(val)
+		if len(p.Config) >= minConfigBlobSize {
+			ids = append(ids, append([]byte(nil), id...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, id := range ids {
+		// the ttl of expiring pages would never release their blob
+		if !s.expiresAt(id).IsZero() {
+			continue
+		}
+		ok, err := s.migratePage(id)
+		if err != nil {
+			return migrated, fmt.Errorf("fail to migrate page %s: %v", id, err)
+		}
+		if ok {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+func (s *storage) migratePage(id []byte) (migrated bool, err error) {
+
+	val, err := s.store.get(id)
+	if err != nil {
+		return false, err
+	}
+	p := &page{}
+	p.decode(val)
+
+	ref, _, err := s.acquireConfigBlob(p.Config)
+	if err != nil {
+		return false, err
+	}
+
+	err = s.store.update(id, func(old []byte) ([]byte, error) {
+		// the page may have been migrated or deleted in the meantime
+		migrated = old != nil && configRef(old) == nil
+		if !migrated {
+			return old, nil
+		}
+		return p.encodeWithConfigRef(ref), nil
+	})
+	if err != nil || !migrated {
+		if releaseErr := s.releaseConfigBlob(ref); releaseErr != nil {
+			log.Print(releaseErr)
+		}
+	}
+	return migrated, err
+}
@@ -0,0 +1,136 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+)
+
+func TestConfigBlobDeduplication(t *testing.T) {
+
+	s := &storage{store: newMemoryStore()}
+	config := `[{"collection": "collection", "count": 10, "content": {"k": {"type": "string", "minLength": 10}}}]` + strings.Repeat(" ", minConfigBlobSize)
+
+	p1, _ := newPage(mgodatagenLabel, config, "db.collection.find()")
+	p2, _ := newPage(mgodatagenLabel, config, "db.collection.find({k: 1})")
+	small, _ := newPage(bsonLabel, "[{}]", "db.collection.find()")
+
+	before := savedPlaygroundCounts(t)
+	for _, p := range []*page{p1, p2, p2, small} {
+		s.save(p)
+	}
+	after := savedPlaygroundCounts(t)
+
+	if want, got := 3, countSavedPages(s.store); want != got {
+		t.Errorf("expected %d pages but got %d", want, got)
+	}
+	if want, got := 2, countConfigBlobRefs(t, s.store, p1.Config); want != got {
+		t.Errorf("expected %d references to the blob but got %d", want, got)
+	}
+	// p2 is only saved once, and reuses the blob saved with p1
+	for labels, want := range map[string]int{
+		`config="blob",type="mgodatagen"`:         1,
+		`config="deduplicated",type="mgodatagen"`: 1,
+	} {
+		if got := after[labels] - before[labels]; want != got {
+			t.Errorf("expected %d playgrounds saved with %s but got %d", want, labels, got)
+		}
+	}
+
+	for _, p := range []*page{p1, p2, small} {
+		loaded, err := s.loadPage(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Config, loaded.Config) || !bytes.Equal(p.Query, loaded.Query) || p.Mode != loaded.Mode {
+			t.Errorf("expected page %s but got %s", p.encode(), loaded.encode())
+		}
+	}
+
+	s.releaseConfigBlob(configRef(mustGet(t, s.store, p1.ID())))
+	if want, got := 1, countConfigBlobRefs(t, s.store, p1.Config); want != got {
+		t.Errorf("expected %d references to the blob but got %d", want, got)
+	}
+	s.releaseConfigBlob(configRef(mustGet(t, s.store, p2.ID())))
+	if want, got := 0, countConfigBlobRefs(t, s.store, p1.Config); want != got {
+		t.Errorf("blob should be deleted, but got %d references", got)
+	}
+}
+
+func TestMigrateConfigBlobs(t *testing.T) {
+
+	s := &storage{store: newMemoryStore()}
+	config := strings.Repeat("a", minConfigBlobSize)
+
+	legacy := make([]*page, 0)
+	for _, query := range []string{"db.collection.find()", "db.collection.find({k: 1})"} {
+		p, _ := newPage(bsonLabel, config, query)
+		s.store.putIfAbsent(p.ID(), p.encode())
+		legacy = append(legacy, p)
+	}
+	small, _ := newPage(bsonLabel, "[{}]", "db.collection.find()")
+	s.store.putIfAbsent(small.ID(), small.encode())
+
+	migrated, err := s.migrateConfigBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := len(legacy), migrated; want != got {
+		t.Errorf("expected %d migrated pages but got %d", want, got)
+	}
+	// running it again doesn't change anything
+	if migrated, _ = s.migrateConfigBlobs(); migrated != 0 {
+		t.Errorf("pages should be migrated only once, but got %d migrated pages", migrated)
+	}
+	if want, got := len(legacy), countConfigBlobRefs(t, s.store, []byte(config)); want != got {
+		t.Errorf("expected %d references to the blob but got %d", want, got)
+	}
+
+	for _, p := range append(legacy, small) {
+		loaded, err := s.loadPage(p.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.encode(), loaded.encode()) {
+			t.Errorf("expected page %s but got %s", p.encode(), loaded.encode())
+		}
+	}
+}
+
+func countConfigBlobRefs(t *testing.T, store playgroundStore, config []byte) int {
+	ref := sha256.Sum256(config)
+	val, err := store.get(configBlobKey(ref[:]))
+	if err == errPlaygroundNotFound {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, _ := decodeConfigBlob(val)
+	return int(refs)
+}
+
+func mustGet(t *testing.T, store playgroundStore, id []byte) []byte {
+	val, err := store.get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
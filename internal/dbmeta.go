@@ -0,0 +1,247 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// database holding the info of the databases in activeDB, so they
+	// can be reused after a restart. Its name isn't 32 char long, so
+	// it's not dropped with playground databases
+	metaDBName = "mongoplayground"
+	// collection holding a dbMetaDocument per database
+	dbMetaCollection = "databases"
+	// the last usage of a database is saved at most once per interval
+	// when it's used, so other servers sharing the same MongoDB instance
+	// know it's still in use. The saved value may be late by this interval
+	lastUsedSaveInterval = 10 * time.Minute
+)
+
+// dbMetaDocument is the info of a database as saved in MongoDB
+type dbMetaDocument struct {
+	Name        string   `bson:"_id"`
+	Collections []string `bson:"collections"`
+	LastUsed    int64    `bson:"lastUsed"`
+	Size        int64    `bson:"size"`
+	// true if the database was found in MongoDB without any info, for
+	// example if the server stopped while creating it. LastUsed then
+	// holds the date it was first found
+	Orphan bool `bson:"orphan,omitempty"`
+}
+
+// databases named after a dbHash or created for a single
+// request are 32 char long
+func isPlaygroundDB(name string) bool {
+	return len(name) == 32
+}
+
+func (s *storage) dbMetaCollection() *mongo.Collection {
+	return s.mongoSession.Database(metaDBName).Collection(dbMetaCollection)
+}
+
+func (s *storage) saveDBMetaInfo(name string, dbInfo dbMetaInfo) {
+
+	doc := dbMetaDocument{
+		Name:        name,
+		Collections: dbInfo.collections,
+		LastUsed:    dbInfo.lastUsed,
+		Size:        dbInfo.size,
+	}
+	_, err := s.dbMetaCollection().ReplaceOne(context.Background(), bson.M{"_id": name}, doc, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Printf("fail to save info of database %s: %v", name, err)
+	}
+}
+
+// save the last usage of the database. It never goes back in time, as
+// other servers may save a more recent usage
+func (s *storage) saveDBLastUsed(name string, lastUsed int64) {
+
+	_, err := s.dbMetaCollection().UpdateOne(context.Background(), bson.M{"_id": name}, bson.M{"$max": bson.M{"lastUsed": lastUsed}})
+	if err != nil {
+		log.Printf("fail to save last usage of database %s: %v", name, err)
+	}
+}
+
+// returns the databases among names used during the last cleanupInterval
+// according to their saved info, with their last usage. They may be used
+// by another server sharing the same MongoDB instance
+func (s *storage) recentlyUsedDB(names []string, now time.Time) (map[string]int64, error) {
+
+	used := map[string]int64{}
+	if len(names) == 0 {
+		return used, nil
+	}
+	cursor, err := s.dbMetaCollection().Find(context.Background(), bson.M{
+		"_id":      bson.M{"$in": names},
+		"orphan":   bson.M{"$ne": true},
+		"lastUsed": bson.M{"$gt": now.Add(-cleanupInterval).Unix()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var docs []dbMetaDocument
+	if err = cursor.All(context.Background(), &docs); err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		used[doc.Name] = doc.LastUsed
+	}
+	return used, nil
+}
+
+// returns true if a database with this saved last usage wasn't used
+// during the last cleanupInterval, by this server or by another one
+func savedLastUsedExpired(lastUsed int64, now time.Time) bool {
+	return now.Sub(time.Unix(lastUsed, 0)) > cleanupInterval+lastUsedSaveInterval
+}
+
+func (s *storage) deleteDBMetaInfo(names []string) {
+
+	if len(names) == 0 {
+		return
+	}
+	_, err := s.dbMetaCollection().DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": names}})
+	if err != nil {
+		log.Printf("fail to delete info of databases %v: %v", names, err)
+	}
+}
+
+// save the last usage of the databases in activeDB. As lastUsed changes
+// on each run, it's saved at most once per lastUsedSaveInterval when a
+// database is used, and for all databases during cleanup and on shutdown
+func (s *storage) saveLastUsed() {
+
+	s.activeDbLock.RLock()
+	updates := make([]mongo.WriteModel, 0, len(s.activeDB))
+	for name, dbInfo := range s.activeDB {
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": name}).
+			SetUpdate(bson.M{"$max": bson.M{"lastUsed": dbInfo.lastUsed}}),
+		)
+	}
+	s.activeDbLock.RUnlock()
+
+	if len(updates) == 0 {
+		return
+	}
+	_, err := s.dbMetaCollection().BulkWrite(context.Background(), updates, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		log.Printf("fail to save last usage of databases: %v", err)
+	}
+}
+
+// reconcileDatabases restores activeDB from the info saved before a restart:
+//
+//   * databases used during the last cleanupInterval are added to activeDB
+//   * other databases are dropped. As the saved last usage may be late by
+//     lastUsedSaveInterval, a database is only dropped once it's unused
+//     for cleanupInterval + lastUsedSaveInterval, so databases used by other
+//     servers sharing the same MongoDB instance are kept
+//   * databases without info are orphans, like databases being created by
+//     another server. They are dropped once they have been known for more
+//     than cleanupInterval, unless their info was saved in the meantime
+//   * info of databases that don't exist anymore is deleted
+func (s *storage) reconcileDatabases() error {
+
+	dbNames, err := s.mongoSession.ListDatabaseNames(context.Background(), bson.D{})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := s.dbMetaCollection().Find(context.Background(), bson.D{})
+	if err != nil {
+		return err
+	}
+	var docs []dbMetaDocument
+	if err = cursor.All(context.Background(), &docs); err != nil {
+		return err
+	}
+	metaInfos := make(map[string]dbMetaDocument, len(docs))
+	for _, doc := range docs {
+		metaInfos[doc.Name] = doc
+	}
+
+	now := time.Now()
+	existingDB := map[string]bool{}
+	toDelete := make([]string, 0)
+	newOrphans := make([]interface{}, 0)
+
+	s.activeDbLock.Lock()
+	for _, name := range dbNames {
+
+		if !isPlaygroundDB(name) {
+			continue
+		}
+		existingDB[name] = true
+
+		meta, ok := metaInfos[name]
+		if !ok {
+			s.orphanDB[name] = now.Unix()
+			newOrphans = append(newOrphans, dbMetaDocument{Name: name, LastUsed: now.Unix(), Orphan: true})
+			continue
+		}
+
+		if !meta.Orphan && savedLastUsedExpired(meta.LastUsed, now) {
+			if err := s.mongoSession.Database(name).Drop(context.Background()); err != nil {
+				log.Printf("fail to drop database %v: %v", name, err)
+				continue
+			}
+			toDelete = append(toDelete, name)
+			continue
+		}
+
+		if meta.Orphan {
+			s.orphanDB[name] = meta.LastUsed
+			continue
+		}
+		s.activeDB[name] = dbMetaInfo{
+			collections: meta.Collections,
+			lastUsed:    meta.LastUsed,
+			lastSaved:   meta.LastUsed,
+			size:        meta.Size,
+		}
+	}
+	nbActive, nbOrphans := len(s.activeDB), len(s.orphanDB)
+	activeDatabasesSize.Set(float64(s.activeDBSize()))
+	s.activeDbLock.Unlock()
+
+	for name := range metaInfos {
+		if !existingDB[name] {
+			toDelete = append(toDelete, name)
+		}
+	}
+	s.deleteDBMetaInfo(toDelete)
+
+	if len(newOrphans) > 0 {
+		if _, err := s.dbMetaCollection().InsertMany(context.Background(), newOrphans); err != nil {
+			return err
+		}
+	}
+
+	activeDatabasesCounter.Set(float64(nbActive))
+	log.Printf("restored %d databases, found %d orphan databases", nbActive, nbOrphans)
+	return nil
+}
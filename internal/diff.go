@@ -0,0 +1,175 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+)
+
+// max size of the table used to compute the longest common subsequence of
+// two texts. Bigger texts are shown as entirely removed and added
+const maxDiffTableSize = 1 << 20
+
+// write the differences between a and b, like:
+//
+//   --- config nJhd-dhf3Ea
+//   +++ config DYlGRQeO0bX
+//     "collection": "collection",
+//   - "count": 10,
+//   + "count": 20,
+//
+// Configurations and queries are saved compacted, often on a single line,
+// so they're split after ',', '{' and '[' instead of on new lines
+func writeDiff(w io.Writer, nameA, nameB string, a, b []byte) {
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+
+	linesA, linesB := splitForDiff(a), splitForDiff(b)
+	for _, l := range diffLines(linesA, linesB) {
+		fmt.Fprintf(w, "%c %s\n", l.op, l.text)
+	}
+}
+
+type diffLine struct {
+	// ' ' for a line in both texts, '-' for a removed line,
+	// '+' for an added line
+	op   byte
+	text string
+}
+
+// compute the differences between two lists of lines, based on
+// their longest common subsequence
+func diffLines(a, b []string) []diffLine {
+
+	// common lines at the start and at the end are kept as is,
+	// which makes the table much smaller for similar texts
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	end := 0
+	for end < len(a)-start && end < len(b)-start && a[len(a)-1-end] == b[len(b)-1-end] {
+		end++
+	}
+
+	diff := make([]diffLine, 0, len(a)+len(b))
+	for _, l := range a[:start] {
+		diff = append(diff, diffLine{op: ' ', text: l})
+	}
+	diff = append(diff, diffMiddle(a[start:len(a)-end], b[start:len(b)-end])...)
+	for _, l := range a[len(a)-end:] {
+		diff = append(diff, diffLine{op: ' ', text: l})
+	}
+	return diff
+}
+
+func diffMiddle(a, b []string) []diffLine {
+
+	diff := make([]diffLine, 0, len(a)+len(b))
+	if (len(a)+1)*(len(b)+1) > maxDiffTableSize {
+		for _, l := range a {
+			diff = append(diff, diffLine{op: '-', text: l})
+		}
+		for _, l := range b {
+			diff = append(diff, diffLine{op: '+', text: l})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the longest common
+	// subsequence of a[i:] and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, diffLine{op: ' ', text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, diffLine{op: '-', text: a[i]})
+			i++
+		default:
+			diff = append(diff, diffLine{op: '+', text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, diffLine{op: '-', text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, diffLine{op: '+', text: b[j]})
+	}
+	return diff
+}
+
+// split a config or a query in lines, after each ',', '{' or '[' and
+// before each '}' or ']' found outside of a string, and on new lines
+func splitForDiff(text []byte) []string {
+
+	lines := make([]string, 0)
+	start := 0
+	var quote byte
+
+	cut := func(end int) {
+		if end > start {
+			lines = append(lines, string(text[start:end]))
+		}
+		start = end
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case ',', '{', '[':
+			cut(i + 1)
+		case '}', ']':
+			cut(i)
+		case '\n':
+			cut(i)
+			start = i + 1
+		}
+	}
+	cut(len(text))
+	return lines
+}
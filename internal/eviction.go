@@ -0,0 +1,150 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// reasons for evicting a database
+	evictionReasonCount = "count"
+	evictionReasonSize  = "size"
+
+	// max time spent dropping the evicted databases
+	evictionDropTimeout = 30 * time.Second
+)
+
+// size in bytes of the documents and indexes of a database
+func databaseSize(db *mongo.Database) int64 {
+
+	var stats struct {
+		DataSize  float64 `bson:"dataSize"`
+		IndexSize float64 `bson:"indexSize"`
+	}
+	err := db.RunCommand(context.Background(), bson.D{{Key: "dbStats", Value: 1}}).Decode(&stats)
+	if err != nil {
+		log.Printf("fail to get size of database %s: %v", db.Name(), err)
+		return 0
+	}
+	return int64(stats.DataSize + stats.IndexSize)
+}
+
+// evictDatabases drops the least recently used databases until the number
+// of databases in activeDB and their total size are under the configured
+// caps. The database keep is never evicted, as it's about to be queried,
+// and neither are the databases in use by other requests.
+//
+// The evicted databases are removed from activeDB first, and dropped once
+// activeDbLock is released, so other requests are not blocked by the drops
+func (s *storage) evictDatabases(keep string) {
+
+	evicted := make([]string, 0)
+	dropped := make(chan struct{})
+
+	s.activeDbLock.Lock()
+	totalSize := s.activeDBSize()
+	for {
+		reason := ""
+		if s.maxActiveDB > 0 && len(s.activeDB) > s.maxActiveDB {
+			reason = evictionReasonCount
+		} else if s.maxActiveDBSize > 0 && totalSize > s.maxActiveDBSize {
+			reason = evictionReasonSize
+		}
+		if reason == "" {
+			break
+		}
+
+		name := s.leastRecentlyUsedDB(keep)
+		if name == "" {
+			break
+		}
+		totalSize -= s.activeDB[name].size
+		delete(s.activeDB, name)
+		// requests needing this database wait for the drop to complete
+		s.dbDrops[name] = dropped
+		evicted = append(evicted, name)
+		evictedDatabasesCounter.WithLabelValues(reason).Inc()
+	}
+	nbActive := len(s.activeDB)
+	s.activeDbLock.Unlock()
+
+	activeDatabasesCounter.Set(float64(nbActive))
+	activeDatabasesSize.Set(float64(totalSize))
+
+	if len(evicted) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), evictionDropTimeout)
+	defer cancel()
+
+	failed := make([]string, 0)
+	for _, name := range evicted {
+		if err := s.mongoSession.Database(name).Drop(ctx); err != nil {
+			log.Printf("fail to evict database %v: %v", name, err)
+			failed = append(failed, name)
+		}
+	}
+
+	s.deleteDBMetaInfo(evicted)
+
+	s.activeDbLock.Lock()
+	for _, name := range evicted {
+		delete(s.dbDrops, name)
+	}
+	// databases that couldn't be dropped are orphans,
+	// dropped by the next cleanup
+	for _, name := range failed {
+		s.orphanDB[name] = time.Now().Add(-cleanupInterval).Unix()
+	}
+	s.activeDbLock.Unlock()
+	close(dropped)
+}
+
+// name of the database of activeDB used the least recently, other than
+// keep and than the databases in use or being created. Caller must hold
+// activeDbLock
+func (s *storage) leastRecentlyUsedDB(keep string) string {
+
+	lru, lastUsed := "", int64(0)
+	for name, dbInfo := range s.activeDB {
+		if name == keep || s.dbUsers[name] > 0 {
+			continue
+		}
+		if _, ok := s.dbCreations[name]; ok {
+			continue
+		}
+		if lru == "" || dbInfo.lastUsed < lastUsed {
+			lru, lastUsed = name, dbInfo.lastUsed
+		}
+	}
+	return lru
+}
+
+// total size of the databases in activeDB. Caller must hold activeDbLock
+func (s *storage) activeDBSize() (size int64) {
+	for _, dbInfo := range s.activeDB {
+		size += dbInfo.size
+	}
+	return size
+}
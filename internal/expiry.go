@@ -0,0 +1,115 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A playground can be saved with an expiry, after which it's removed from
+// the playground store by the ttl of its entry. Like private playgrounds,
+// expiring playgrounds have a random id: a content hash would be shared
+// with the permanent playground having the same content.
+//
+// The expiration date of an expiring playground is saved in the playground
+// store with the key expiry/{id}, as an uint64 unix timestamp. This record
+// outlives the playground for expiredNoticePeriod, so the playground can
+// be reported as expired instead of not existing
+const (
+	expiryPrefix = "expiry/"
+	// how long an expired playground is reported as expired
+	expiredNoticePeriod = 30 * 24 * time.Hour
+
+	errExpiredPlayground = "this playground has expired"
+)
+
+// the supported expiries of a playground, as sent by the
+// 'expiry' form field or the Expiry field of the api
+var expiries = map[string]time.Duration{
+	"1d": 24 * time.Hour,
+	"1w": 7 * 24 * time.Hour,
+	"1m": 30 * 24 * time.Hour,
+}
+
+func expiryKey(id []byte) []byte {
+	return append([]byte(expiryPrefix), id...)
+}
+
+// returns the ttl of a playground saved with this expiry, or
+// 0 if expiry is empty and the playground never expires
+func parseExpiry(expiry string) (time.Duration, error) {
+	if expiry == "" {
+		return 0, nil
+	}
+	ttl, ok := expiries[expiry]
+	if !ok {
+		return 0, newPlaygroundError(requestError, "invalid expiry '%s', expecting one of '1d', '1w' or '1m'", expiry)
+	}
+	return ttl, nil
+}
+
+// returns the ttl of the records kept along a playground
+// expiring after ttl, or 0 if it never expires
+func expiryRecordTTL(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		return 0
+	}
+	return ttl + expiredNoticePeriod
+}
+
+// save the expiration date of the playground with this id
+func (s *storage) recordExpiry(id []byte, ttl time.Duration) (inserted bool, err error) {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(time.Now().Add(ttl).Unix()))
+	return s.store.putIfAbsentWithTTL(expiryKey(id), v, expiryRecordTTL(ttl))
+}
+
+// save the page as an expiring playground, and return its random id
+func (s *storage) saveExpiring(p *page, ttl time.Duration) (id []byte, err error) {
+	id, err = s.saveWithRandomID(p, nil, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("fail to save expiring playground: %v", err)
+	}
+	return id, nil
+}
+
+// returns the expiration date of the playground with this id,
+// or the zero time if it never expires
+func (s *storage) expiresAt(id []byte) time.Time {
+	v, err := s.store.get(expiryKey(id))
+	if err != nil {
+		return time.Time{}
+	}
+	return decodeExpiry(v)
+}
+
+// decode an expiry record saved by recordExpiry
+func decodeExpiry(v []byte) time.Time {
+	if len(v) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+}
+
+func serveExpiredPlayground(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte(errExpiredPlayground))
+}
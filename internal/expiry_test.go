@@ -0,0 +1,186 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiringPlayground(t *testing.T) {
+
+	t.Parallel()
+
+	store := newMemoryStore()
+	s := &storage{store: store}
+
+	public := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()"}`)
+	expiring := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Expiry":"1w"}`)
+	private := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Expiry":"1d","Private":true}`)
+
+	if expiring.ID == public.ID || expiring.ExpiresAt == nil {
+		t.Fatalf("expiring playground should have a random id and an expiration date, got %+v", expiring)
+	}
+	if want, got := time.Now().Add(7*24*time.Hour), *expiring.ExpiresAt; got.Before(want.Add(-time.Minute)) || got.After(want) {
+		t.Errorf("expected expiration date %v but got %v", want, got)
+	}
+
+	resp := httptest.NewRecorder()
+	s.viewHandler(resp, httptest.NewRequest(http.MethodGet, "/p/"+expiring.ID+jsonExportSuffix, nil))
+	var exported exportedPage
+	json.Unmarshal(resp.Body.Bytes(), &exported)
+	if exported.Metadata.ExpiresAt == nil || !exported.Metadata.ExpiresAt.Equal(*expiring.ExpiresAt) {
+		t.Errorf("expected expiration date %v but got %v", expiring.ExpiresAt, exported.Metadata.ExpiresAt)
+	}
+
+	// the playgrounds expire, but not the records of their expiry
+	store.lock.Lock()
+	store.expiresAt[expiring.ID] = time.Now()
+	store.expiresAt[private.ID] = time.Now()
+	store.lock.Unlock()
+
+	viewTests := []struct {
+		name         string
+		url          string
+		responseCode int
+		body         string
+	}{
+		{
+			name:         "expired playground",
+			url:          "/p/" + expiring.ID,
+			responseCode: http.StatusGone,
+			body:         errExpiredPlayground,
+		},
+		{
+			name:         "export of expired playground",
+			url:          "/p/" + expiring.ID + queryExportSuffix,
+			responseCode: http.StatusGone,
+			body:         errExpiredPlayground,
+		},
+		{
+			name:         "expired private playground without token",
+			url:          "/p/" + private.ID,
+			responseCode: http.StatusNotFound,
+			body:         errNoMatchingPlayground,
+		},
+		{
+			name:         "expired private playground with token",
+			url:          "/p/" + private.ID + "?token=" + private.Token,
+			responseCode: http.StatusGone,
+			body:         errExpiredPlayground,
+		},
+		{
+			name:         "unknown playground",
+			url:          "/p/aaaaaaaaaaa",
+			responseCode: http.StatusNotFound,
+			body:         errNoMatchingPlayground,
+		},
+	}
+
+	for _, tt := range viewTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			s.viewHandler(resp, httptest.NewRequest(http.MethodGet, tt.url, nil))
+
+			if want, got := tt.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d", want, got)
+			}
+			if want, got := tt.body, resp.Body.String(); want != got {
+				t.Errorf("expected body '%s' but got '%s'", want, got)
+			}
+		})
+	}
+}
+
+func TestInvalidExpiry(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{store: newMemoryStore()}
+
+	resp := httptest.NewRecorder()
+	s.apiSaveHandler(resp, httptest.NewRequest(http.MethodPost, apiSaveEndpoint, strings.NewReader(`{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Expiry":"2y"}`)))
+
+	if want, got := http.StatusBadRequest, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+
+	t.Parallel()
+
+	store := newMemoryStore()
+	store.putIfAbsentWithTTL([]byte("a"), []byte("1"), 10*time.Millisecond)
+
+	// the ttl is kept when the playground is updated
+	store.update([]byte("a"), func(old []byte) ([]byte, error) {
+		return []byte("2"), nil
+	})
+	if got, err := store.get([]byte("a")); err != nil || string(got) != "2" {
+		t.Errorf("expected 2 but got %s, %v", got, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, err := store.get([]byte("a")); err == nil {
+		t.Errorf("playground should have expired")
+	}
+	if inserted, _ := store.putIfAbsent([]byte("a"), []byte("3")); !inserted {
+		t.Errorf("an expired playground should be replaced")
+	}
+}
+
+func TestSavedPlaygroundStatsAfterRestart(t *testing.T) {
+
+	s := &storage{store: newMemoryStore()}
+	permanent, _ := newPage(mgodatagenLabel, `[{"collection": "collection", "count": 10, "content": {}}]`, "db.collection.find()")
+	private, _ := newPage(bsonLabel, `[{"k": 1}]`, "db.collection.find()")
+	expiring, _ := newPage(bsonLabel, `[{"k": 2}]`, "db.collection.find()")
+	privateExpiring, _ := newPage(bsonLabel, `[{"k": 3}]`, "db.collection.find()")
+
+	savedPlaygroundSize.Reset()
+	if _, _, err := s.save(permanent); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.savePrivate(private, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.saveExpiring(expiring, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.savePrivate(privateExpiring, "", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	before := savedPlaygroundCounts(t)
+
+	// the stats are computed from the store on startup
+	savedPlaygroundSize.Reset()
+	computeSavedPlaygroundStats(s.store)
+	after := savedPlaygroundCounts(t)
+
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Errorf("expected %v after a restart but got %v", before, after)
+	}
+	if want, got := 1, after[`config="inline",type="mgodatagen"`]; want != got {
+		t.Errorf("expected %d saved playground but got %d", want, got)
+	}
+}
@@ -58,20 +58,14 @@ func (s *storage) healthCheck() []byte {
 		Status: statusUp,
 	}
 
-	badger := serviceInfo{
-		Name:   "badger",
-		Status: "UP",
-	}
-
-	if s.kvStore.IsClosed() {
-		badger.Status = statusDown
-		badger.Cause = "database is closed"
+	store := s.store.health()
+	if store.Status != statusUp {
 		response.Status = statusDegrade
 	}
 
 	mongodb := serviceInfo{
 		Name:    "mongodb",
-		Version: string(s.mongoVersion),
+		Version: string(s.mongoVersion()),
 		Status:  statusUp,
 	}
 
@@ -87,7 +81,7 @@ func (s *storage) healthCheck() []byte {
 	}
 
 	response.Services = []serviceInfo{
-		badger,
+		store,
 		mongodb,
 		s.backupServiceStatus,
 	}
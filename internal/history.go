@@ -0,0 +1,141 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// When a playground is saved from another one, for example after editing
+// it, the id of the original playground is recorded as its parent, and the
+// new playground as one of the forks of the parent. Both are saved in the
+// playground store:
+//
+//   parent/{id} -> id of the parent
+//   forks/{id}  -> ids of the forks, each pageIDLength bytes long
+const (
+	parentPrefix = "parent/"
+	forksPrefix  = "forks/"
+	// max number of ancestors listed by /p/{id}/history
+	maxHistoryDepth = 100
+	// max number of forks recorded for a playground
+	maxRecordedForks = 1000
+)
+
+// ancestors and forks of a playground, returned by /p/{id}/history
+type pageHistory struct {
+	ID string
+	// ids of the parent, of the parent of the parent and so on
+	Ancestors []string
+	// ids of the playgrounds saved from this one
+	Forks []string
+}
+
+func parentKey(id []byte) []byte {
+	return append([]byte(parentPrefix), id...)
+}
+
+func forksKey(id []byte) []byte {
+	return append([]byte(forksPrefix), id...)
+}
+
+// return the id of the playground a new playground was saved from. It's
+// the 'parent' form field if any, otherwise the playground viewed when
+// the request was sent, found in the Referer header. The parent can be
+// a slug
+func (s *storage) parentFromRequest(r *http.Request, parent string) []byte {
+
+	if parent == "" {
+		referer, err := url.Parse(r.Referer())
+		if err != nil || !strings.HasPrefix(referer.Path, viewEndpoint) {
+			return nil
+		}
+		parent = referer.Path
+	}
+	id, _ := s.extractPageIDFromURL(parent)
+	return id
+}
+
+// record parent as the parent of the newly saved playground with this id.
+// Unknown parents are ignored
+func (s *storage) recordParent(id, parent []byte) error {
+
+	// private playgrounds are never listed in the history of
+	// other playgrounds, and expiring ones would outlive it
+	if len(parent) == 0 || bytes.Equal(id, parent) || s.isPrivate(parent) || s.isPrivate(id) ||
+		!s.expiresAt(parent).IsZero() || !s.expiresAt(id).IsZero() {
+		return nil
+	}
+	if _, err := s.loadPage(parent); err != nil {
+		return nil
+	}
+
+	inserted, err := s.store.putIfAbsent(parentKey(id), parent)
+	if err != nil || !inserted {
+		return err
+	}
+	return s.store.update(forksKey(parent), func(old []byte) ([]byte, error) {
+		if len(old) >= maxRecordedForks*pageIDLength {
+			return old, nil
+		}
+		return append(append([]byte(nil), old...), id...), nil
+	})
+}
+
+// return the ancestors and the forks of the playground
+func (s *storage) history(id []byte) (*pageHistory, error) {
+
+	h := &pageHistory{
+		ID:        string(id),
+		Ancestors: []string{},
+		Forks:     []string{},
+	}
+
+	current := id
+	for len(h.Ancestors) < maxHistoryDepth {
+		parent, err := s.store.get(parentKey(current))
+		if err == errPlaygroundNotFound {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fail to load parent of %s: %v", current, err)
+		}
+		h.Ancestors = append(h.Ancestors, string(parent))
+		current = parent
+	}
+
+	forks, err := s.store.get(forksKey(id))
+	if err != nil && err != errPlaygroundNotFound {
+		return nil, fmt.Errorf("fail to load forks of %s: %v", id, err)
+	}
+	for i := 0; i+pageIDLength <= len(forks); i += pageIDLength {
+		h.Forks = append(h.Forks, string(forks[i:i+pageIDLength]))
+	}
+	return h, nil
+}
+
+// write the differences between the config and the query of two
+// playgrounds as plain text
+func serveDiff(w http.ResponseWriter, id []byte, p *page, otherID []byte, other *page) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeDiff(w, fmt.Sprintf("config %s", id), fmt.Sprintf("config %s", otherID), p.Config, other.Config)
+	writeDiff(w, fmt.Sprintf("query %s", id), fmt.Sprintf("query %s", otherID), p.Query, other.Query)
+}
@@ -0,0 +1,152 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{store: newMemoryStore()}
+
+	root, _, _ := s.save(&page{Mode: bsonMode, Config: []byte(`[{"k":1}]`), Query: []byte("db.collection.find()")})
+	child := saveFrom(t, s, viewEndpoint+string(root), "", `[{"k":2}]`)
+	grandChild := saveFrom(t, s, "", string(child), `[{"k":3}]`)
+	otherChild := saveFrom(t, s, viewEndpoint+string(root)+"/config", "", `[{"k":4}]`)
+	// unknown parents are ignored
+	orphan := saveFrom(t, s, "", "unknownURL0", `[{"k":5}]`)
+	// once a playground is edited, the web page url is the root
+	// of the site, and the loaded playground is sent as parent
+	edited := saveFrom(t, s, "/", string(grandChild), `[{"k":6}]`)
+
+	historyTests := []struct {
+		id   []byte
+		want pageHistory
+	}{
+		{
+			id:   root,
+			want: pageHistory{ID: string(root), Ancestors: []string{}, Forks: []string{string(child), string(otherChild)}},
+		},
+		{
+			id:   grandChild,
+			want: pageHistory{ID: string(grandChild), Ancestors: []string{string(child), string(root)}, Forks: []string{string(edited)}},
+		},
+		{
+			id:   orphan,
+			want: pageHistory{ID: string(orphan), Ancestors: []string{}, Forks: []string{}},
+		},
+	}
+
+	for _, tt := range historyTests {
+		resp := httptest.NewRecorder()
+		s.viewHandler(resp, httptest.NewRequest(http.MethodGet, viewEndpoint+string(tt.id)+historySuffix, nil))
+
+		var got pageHistory
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Fatalf("fail to decode history: %v", err)
+		}
+		if !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("expected history %+v but got %+v", tt.want, got)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	s.viewHandler(resp, httptest.NewRequest(http.MethodGet, viewEndpoint+string(root)+diffSuffix+string(child), nil))
+
+	want := `--- config ` + string(root) + `
++++ config ` + string(child) + `
+  [
+  {
+- "k":1
++ "k":2
+  }
+  ]
+--- query ` + string(root) + `
++++ query ` + string(child) + `
+  db.collection.find()
+`
+	if got := resp.Body.String(); want != got {
+		t.Errorf("expected diff\n%s\nbut got\n%s", want, got)
+	}
+}
+
+// save a playground with the web page from the page at referer
+func saveFrom(t *testing.T, s *storage, referer, parent, config string) []byte {
+
+	params := url.Values{"mode": {bsonLabel}, "config": {config}, "query": {"db.collection.find()"}, "parent": {parent}}
+	req := httptest.NewRequest(http.MethodPost, saveEndpoint, strings.NewReader(params.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", "https://mongoplayground.net"+referer)
+
+	resp := httptest.NewRecorder()
+	s.saveHandler(resp, req)
+
+	body := resp.Body.String()
+	return []byte(body[len(body)-pageIDLength:])
+}
+
+func TestDiffLines(t *testing.T) {
+
+	t.Parallel()
+
+	diffTests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{
+			name: "same text",
+			a:    `[{"a":1,"b":2}]`,
+			b:    `[{"a":1,"b":2}]`,
+			want: "  [|  {|  \"a\":1,|  \"b\":2|  }|  ]",
+		},
+		{
+			name: "field added",
+			a:    `[{"a":1}]`,
+			b:    `[{"a":1,"b":"x,y"}]`,
+			want: "  [|  {|- \"a\":1|+ \"a\":1,|+ \"b\":\"x,y\"|  }|  ]",
+		},
+		{
+			name: "query on several lines",
+			a:    "db.collection.find()\ndb.collection.count()",
+			b:    "db.collection.find({k: 1})\ndb.collection.count()",
+			want: "- db.collection.find()|+ db.collection.find({|+ k: 1|+ })|  db.collection.count()",
+		},
+	}
+
+	for _, tt := range diffTests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make([]string, 0)
+			for _, l := range diffLines(splitForDiff([]byte(tt.a)), splitForDiff([]byte(tt.b))) {
+				lines = append(lines, string(l.op)+" "+l.text)
+			}
+			if got := strings.Join(lines, "|"); tt.want != got {
+				t.Errorf("expected %s but got %s", tt.want, got)
+			}
+		})
+	}
+}
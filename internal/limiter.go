@@ -0,0 +1,99 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// default max number of queries running at the same time
+	defaultMaxConcurrentRuns = 32
+	// default max number of queries waiting for a free slot
+	defaultMaxQueuedRuns = 256
+	// delay in seconds sent in the Retry-After header when the server is busy
+	busyRetryAfter = 5
+
+	errServerBusy = "server busy, retry in a few seconds"
+)
+
+// runLimiter bounds the number of queries sent to MongoDB at
+// the same time. Queries exceeding this number wait in a queue
+// of bounded size, and are rejected once the queue is full
+type runLimiter struct {
+	slots    chan struct{}
+	queued   int64
+	maxQueue int64
+}
+
+// create a new limiter. If maxConcurrent is negative, the
+// number of concurrent queries is not bounded
+func newRunLimiter(maxConcurrent, maxQueue int) *runLimiter {
+	if maxConcurrent < 0 {
+		return &runLimiter{}
+	}
+	if maxConcurrent == 0 {
+		maxConcurrent = defaultMaxConcurrentRuns
+	}
+	if maxQueue <= 0 {
+		maxQueue = defaultMaxQueuedRuns
+	}
+	return &runLimiter{
+		slots:    make(chan struct{}, maxConcurrent),
+		maxQueue: int64(maxQueue),
+	}
+}
+
+// acquire waits for a free slot. Caller must call release once
+// the query is done. An error is returned if the queue is full
+// or if ctx is done before a slot is available
+func (l *runLimiter) acquire(ctx context.Context) (release func(), err error) {
+
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > l.maxQueue {
+		atomic.AddInt64(&l.queued, -1)
+		rejectedRunsCounter.Inc()
+		return nil, &playgroundError{kind: busyError, msg: errServerBusy}
+	}
+	runQueueDepth.Inc()
+
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&l.queued, -1)
+		runQueueDepth.Dec()
+		runQueueWaitDurations.Observe(time.Since(start).Seconds())
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, &playgroundError{kind: busyError, msg: errServerBusy}
+	}
+}
@@ -0,0 +1,104 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := newRunLimiter(1, 1)
+
+	release, err := limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first query should get a slot: %v", err)
+	}
+
+	// the second query waits in the queue until the first one is done
+	acquired := make(chan error)
+	go func() {
+		release, err := limiter.acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+
+	for i := 0; i < 100 && queuedRuns(limiter) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the queue is full, the third query is rejected
+	_, err = limiter.acquire(context.Background())
+	checkBusyError(t, err)
+
+	release()
+	if err := <-acquired; err != nil {
+		t.Errorf("queued query should get a slot: %v", err)
+	}
+}
+
+func TestRunLimiterContextDone(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := newRunLimiter(1, 1)
+	release, _ := limiter.acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := limiter.acquire(ctx)
+	checkBusyError(t, err)
+
+	if want, got := int64(0), queuedRuns(limiter); want != got {
+		t.Errorf("expected %d queued queries but got %d", want, got)
+	}
+}
+
+func TestRunLimiterDisabled(t *testing.T) {
+
+	t.Parallel()
+
+	limiter := newRunLimiter(-1, 0)
+	for i := 0; i < defaultMaxConcurrentRuns+defaultMaxQueuedRuns+1; i++ {
+		if _, err := limiter.acquire(context.Background()); err != nil {
+			t.Fatalf("disabled limiter should not reject queries: %v", err)
+		}
+	}
+}
+
+func queuedRuns(l *runLimiter) int64 {
+	return atomic.LoadInt64(&l.queued)
+}
+
+func checkBusyError(t *testing.T, err error) {
+	t.Helper()
+
+	var pErr *playgroundError
+	if !errors.As(err, &pErr) || pErr.kind != busyError {
+		t.Errorf("expected a busy error but got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// memoryStore keeps the playgrounds in memory. They are lost
+// when the server stops, so it's mostly useful for tests
+type memoryStore struct {
+	lock        sync.RWMutex
+	playgrounds map[string][]byte
+	// expiration date of the playgrounds saved with a ttl
+	expiresAt map[string]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		playgrounds: map[string][]byte{},
+		expiresAt:   map[string]time.Time{},
+	}
+}
+
+// return the playground with this id, unless it has expired. Expired
+// playgrounds are kept in memory until they're overwritten
+func (m *memoryStore) lookup(id string) ([]byte, bool) {
+	val, ok := m.playgrounds[id]
+	if expiresAt, expiring := m.expiresAt[id]; ok && expiring && !time.Now().Before(expiresAt) {
+		return nil, false
+	}
+	return val, ok
+}
+
+func (m *memoryStore) get(id []byte) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	val, ok := m.lookup(string(id))
+	if !ok {
+		return nil, errPlaygroundNotFound
+	}
+	return val, nil
+}
+
+func (m *memoryStore) putIfAbsent(id, val []byte) (bool, error) {
+	return m.putIfAbsentWithTTL(id, val, 0)
+}
+
+func (m *memoryStore) putIfAbsentWithTTL(id, val []byte, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.lookup(string(id)); ok {
+		return false, nil
+	}
+	m.playgrounds[string(id)] = append([]byte(nil), val...)
+	delete(m.expiresAt, string(id))
+	if ttl > 0 {
+		m.expiresAt[string(id)] = time.Now().Add(ttl)
+	}
+	return true, nil
+}
+
+func (m *memoryStore) update(id []byte, fn func(old []byte) ([]byte, error)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, ok := m.lookup(string(id))
+	if !ok {
+		// an expired playground is replaced by a new one
+		delete(m.expiresAt, string(id))
+	}
+	val, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		delete(m.playgrounds, string(id))
+		delete(m.expiresAt, string(id))
+	} else {
+		m.playgrounds[string(id)] = append([]byte(nil), val...)
+	}
+	return nil
+}
+
+func (m *memoryStore) delete(id []byte) error {
+	m.lock.Lock()
+	delete(m.playgrounds, string(id))
+	delete(m.expiresAt, string(id))
+	m.lock.Unlock()
+	return nil
+}
+
+// playgrounds are iterated by id, like in badger
+func (m *memoryStore) iterate(fn func(id, val []byte) error) error {
+	return m.iteratePrefix(nil, false, fn)
+}
+
+func (m *memoryStore) iteratePrefix(prefix []byte, reverse bool, fn func(id, val []byte) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ids := make([]string, 0)
+	for id := range m.playgrounds {
+		if _, ok := m.lookup(id); ok && strings.HasPrefix(id, string(prefix)) {
+			ids = append(ids, id)
+		}
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	} else {
+		sort.Strings(ids)
+	}
+
+	for _, id := range ids {
+		err := fn([]byte(id), m.playgrounds[id])
+		if errors.Is(err, errStopIteration) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup in the same format as mongoStore, so it can be
+// restored in MongoDB with mongorestore
+func (m *memoryStore) backup(w io.Writer) error {
+	return m.iterate(func(id, val []byte) error {
+		return writePlaygroundDocument(w, id, val)
+	})
+}
+
+func (m *memoryStore) health() serviceInfo {
+	return serviceInfo{
+		Name:   memoryStoreName,
+		Status: statusUp,
+	}
+}
+
+func (m *memoryStore) close() error {
+	return nil
+}
+
+// write a playground as a bson document, like the ones saved by mongoStore
+func writePlaygroundDocument(w io.Writer, id, val []byte) error {
+	doc, err := bson.Marshal(playgroundDocument{ID: string(id), Value: val})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(doc)
+	return err
+}
@@ -0,0 +1,227 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collection of metaDBName holding the playgrounds saved by mongoStore
+const playgroundCollection = "playgrounds"
+
+// playgroundDocument is a playground as saved in MongoDB
+type playgroundDocument struct {
+	ID    string `bson:"_id"`
+	Value []byte `bson:"value"`
+	// set for playgrounds saved with a ttl. MongoDB removes them
+	// once expired, but only every minute, so expired documents
+	// are also filtered out when reading
+	ExpireAt *time.Time `bson:"expireAt,omitempty"`
+}
+
+// mongoStore keeps the playgrounds in a MongoDB collection, so
+// several servers without local disk can share them
+type mongoStore struct {
+	collection *mongo.Collection
+}
+
+func newMongoStore(session *mongo.Client) (*mongoStore, error) {
+
+	collection := session.Database(metaDBName).Collection(playgroundCollection)
+
+	_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"expireAt": 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to create ttl index: %v", err)
+	}
+	return &mongoStore{collection: collection}, nil
+}
+
+// match the document with this id, unless it has expired
+func notExpired(id []byte) bson.M {
+	return bson.M{
+		"_id": string(id),
+		"$or": bson.A{
+			bson.M{"expireAt": bson.M{"$exists": false}},
+			bson.M{"expireAt": bson.M{"$gt": time.Now()}},
+		},
+	}
+}
+
+func (m *mongoStore) get(id []byte) ([]byte, error) {
+	var doc playgroundDocument
+	err := m.collection.FindOne(context.Background(), notExpired(id)).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, errPlaygroundNotFound
+	}
+	return doc.Value, err
+}
+
+func (m *mongoStore) putIfAbsent(id, val []byte) (bool, error) {
+	return m.putIfAbsentWithTTL(id, val, 0)
+}
+
+func (m *mongoStore) putIfAbsentWithTTL(id, val []byte, ttl time.Duration) (bool, error) {
+
+	doc := playgroundDocument{ID: string(id), Value: val}
+	if ttl > 0 {
+		expireAt := time.Now().Add(ttl)
+		doc.ExpireAt = &expireAt
+	}
+
+	_, err := m.collection.InsertOne(context.Background(), doc)
+	if !mongo.IsDuplicateKeyError(err) {
+		return err == nil, err
+	}
+	// the existing document may have expired without
+	// being removed yet, in which case it's replaced
+	res, err := m.collection.ReplaceOne(context.Background(), bson.M{
+		"_id":      string(id),
+		"expireAt": bson.M{"$lte": time.Now()},
+	}, doc)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// the new value is only written if the document still holds the value
+// passed to fn, otherwise fn is called again with the new value
+func (m *mongoStore) update(id []byte, fn func(old []byte) ([]byte, error)) error {
+	// the ttl of a playground is kept, as only
+	// its value is updated
+	for {
+		old, err := m.get(id)
+		found := err == nil
+		if !found && !errors.Is(err, errPlaygroundNotFound) {
+			return err
+		}
+		val, err := fn(old)
+		if err != nil {
+			return err
+		}
+
+		filter := bson.M{"_id": string(id), "value": old}
+		switch {
+		case !found && val == nil:
+			return nil
+		case !found:
+			inserted, err := m.putIfAbsent(id, val)
+			if err != nil || inserted {
+				return err
+			}
+			continue
+		case val == nil:
+			deleted, err := m.collection.DeleteOne(context.Background(), filter)
+			if err != nil || deleted.DeletedCount == 1 {
+				return err
+			}
+			continue
+		}
+		res, err := m.collection.UpdateOne(context.Background(), filter, bson.M{"$set": bson.M{"value": val}})
+		if err != nil || res.MatchedCount == 1 {
+			return err
+		}
+	}
+}
+
+func (m *mongoStore) delete(id []byte) error {
+	_, err := m.collection.DeleteOne(context.Background(), bson.M{"_id": string(id)})
+	return err
+}
+
+func (m *mongoStore) iterate(fn func(id, val []byte) error) error {
+	return m.iteratePrefix(nil, false, fn)
+}
+
+func (m *mongoStore) iteratePrefix(prefix []byte, reverse bool, fn func(id, val []byte) error) error {
+
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"expireAt": bson.M{"$exists": false}},
+			bson.M{"expireAt": bson.M{"$gt": time.Now()}},
+		},
+	}
+	if len(prefix) > 0 {
+		// ids starting with prefix are the ones between prefix and
+		// prefix with its last byte incremented, like 'audit0' for 'audit/'
+		end := append([]byte(nil), prefix...)
+		end[len(end)-1]++
+		filter["_id"] = bson.M{"$gte": string(prefix), "$lt": string(end)}
+	}
+	order := 1
+	if reverse {
+		order = -1
+	}
+
+	cursor, err := m.collection.Find(context.Background(), filter, options.Find().SetSort(bson.M{"_id": order}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var doc playgroundDocument
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		err := fn([]byte(doc.ID), doc.Value)
+		if errors.Is(err, errStopIteration) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// backup in mongodump format, can be restored with mongorestore
+func (m *mongoStore) backup(w io.Writer) error {
+	return m.iterate(func(id, val []byte) error {
+		return writePlaygroundDocument(w, id, val)
+	})
+}
+
+func (m *mongoStore) health() serviceInfo {
+
+	info := serviceInfo{
+		Name:   mongoStoreName,
+		Status: statusUp,
+	}
+	if _, err := m.collection.EstimatedDocumentCount(context.Background()); err != nil {
+		info.Status = statusDown
+		info.Cause = strconv.Quote(err.Error())
+	}
+	return info
+}
+
+// the mongodb session is closed by storage
+func (m *mongoStore) close() error {
+	return nil
+}
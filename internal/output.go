@@ -0,0 +1,317 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/feliixx/mongoextjson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+const (
+	// compact shell syntax, as displayed in the web page:
+	//   [{"_id":ObjectId("5a934e000102030405000000"),"k":1}]
+	shellOutput = "shell"
+	// same as shell, but indented
+	prettyOutput = "pretty"
+	// Extended JSON v2 in canonical mode:
+	//   [{"_id":{"$oid":"5a934e000102030405000000"},"k":{"$numberInt":"1"}}]
+	canonicalOutput = "canonical"
+	// Extended JSON v2 in relaxed mode:
+	//   [{"_id":{"$oid":"5a934e000102030405000000"},"k":1}]
+	relaxedOutput = "relaxed"
+	// one line per document, one column per field. Nested fields are
+	// flattened using dotted paths, like "a.b" or "array.0"
+	csvOutput = "csv"
+	// documents encoded in bson, one after the other, like in
+	// a file created by mongodump
+	bsonOutput = "bson"
+
+	errInvalidOutput = "invalid output, expecting one of 'shell', 'pretty', 'canonical', 'relaxed', 'csv' or 'bson'"
+
+	prettyIndent = "  "
+)
+
+func isValidOutput(output string) bool {
+	switch output {
+	case shellOutput, prettyOutput, canonicalOutput, relaxedOutput, csvOutput, bsonOutput:
+		return true
+	}
+	return false
+}
+
+func setOutputHeaders(w http.ResponseWriter, output string) {
+	switch output {
+	case canonicalOutput, relaxedOutput:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	case csvOutput:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="result.csv"`)
+	case bsonOutput:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="result.bson"`)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+}
+
+// format the result of a query. In explain mode, the explain
+// document is returned as is instead of an array of documents
+func (r *runResult) format(output string) (b []byte, err error) {
+
+	switch output {
+	case shellOutput:
+		b, err = r.marshalShell()
+	case prettyOutput:
+		b, err = r.marshalShell()
+		if err == nil {
+			b = indentShell(b)
+		}
+	case canonicalOutput:
+		b, err = r.marshalExtJSON(true)
+	case relaxedOutput:
+		b, err = r.marshalExtJSON(false)
+	case csvOutput:
+		b, err = r.marshalCSV()
+	case bsonOutput:
+		b = bytes.Join(rawToBytes(r.docs), nil)
+	default:
+		return nil, &playgroundError{kind: requestError, msg: errInvalidOutput}
+	}
+
+	if err != nil {
+		return nil, newPlaygroundError(executionError, "fail to format result as %s: %v", output, err)
+	}
+	return b, nil
+}
+
+func (r *runResult) marshalShell() ([]byte, error) {
+
+	docs := make(bson.A, len(r.docs))
+	for i, raw := range r.docs {
+		var doc bson.M
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		docs[i] = doc
+	}
+	if r.explainMode != "" {
+		return mongoextjson.Marshal(docs[0])
+	}
+	return mongoextjson.Marshal(docs)
+}
+
+func (r *runResult) marshalExtJSON(canonical bool) ([]byte, error) {
+
+	if r.explainMode != "" {
+		return bson.MarshalExtJSON(r.docs[0], canonical, false)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	buf.WriteByte('[')
+	for i, raw := range r.docs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		b, err := bson.MarshalExtJSON(raw, canonical, false)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+func (r *runResult) marshalCSV() ([]byte, error) {
+
+	// columns are ordered by first appearance
+	var columns []string
+	seen := map[string]bool{}
+	rows := make([]map[string]string, 0, len(r.docs))
+
+	for _, raw := range r.docs {
+		row := map[string]string{}
+		if err := flattenDocument(raw, "", row, func(path string) {
+			if !seen[path] {
+				seen[path] = true
+				columns = append(columns, path)
+			}
+		}); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	w := csv.NewWriter(buf)
+	w.Write(columns)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, col := range columns {
+			record[i] = row[col]
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// flatten a document, so {"a":{"b":1},"c":[1,2]} gives
+//
+//   a.b -> 1
+//   c.0 -> 1
+//   c.1 -> 2
+func flattenDocument(raw bson.Raw, prefix string, row map[string]string, addColumn func(string)) error {
+
+	elements, err := raw.Elements()
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+
+		path := e.Key()
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		v := e.Value()
+		switch v.Type {
+		case bsontype.EmbeddedDocument:
+			err = flattenDocument(v.Document(), path, row, addColumn)
+		case bsontype.Array:
+			err = flattenDocument(bson.Raw(v.Array()), path, row, addColumn)
+		default:
+			addColumn(path)
+			row[path] = csvValue(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func csvValue(v bson.RawValue) string {
+	switch v.Type {
+	case bsontype.String:
+		return v.StringValue()
+	case bsontype.ObjectID:
+		return v.ObjectID().Hex()
+	case bsontype.Int32:
+		return strconv.Itoa(int(v.Int32()))
+	case bsontype.Int64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case bsontype.Double:
+		return strconv.FormatFloat(v.Double(), 'g', -1, 64)
+	case bsontype.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case bsontype.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case bsontype.Null, bsontype.Undefined:
+		return ""
+	case bsontype.Decimal128:
+		return v.Decimal128().String()
+	}
+	// remaining types are rare enough, use their extended json representation
+	return fmt.Sprint(v)
+}
+
+// indent the output of mongoextjson.Marshal(). Commas inside function
+// calls like BinData(0,"...") don't start a new line
+func indentShell(b []byte) []byte {
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(b)*2))
+
+	depth, parenDepth := 0, 0
+	inString, escaped := false, false
+
+	newLine := func() {
+		buf.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			buf.WriteString(prettyIndent)
+		}
+	}
+
+	for i, c := range b {
+
+		if inString {
+			buf.WriteByte(c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+			buf.WriteByte(c)
+		case '(':
+			parenDepth++
+			buf.WriteByte(c)
+		case ')':
+			parenDepth--
+			buf.WriteByte(c)
+		case '{', '[':
+			buf.WriteByte(c)
+			// keep empty documents and arrays on a single line
+			if i+1 < len(b) && (b[i+1] == '}' || b[i+1] == ']') {
+				continue
+			}
+			depth++
+			newLine()
+		case '}', ']':
+			if i > 0 && (b[i-1] == '{' || b[i-1] == '[') {
+				buf.WriteByte(c)
+				continue
+			}
+			depth--
+			newLine()
+			buf.WriteByte(c)
+		case ',':
+			buf.WriteByte(c)
+			if parenDepth == 0 {
+				newLine()
+			}
+		case ':':
+			buf.WriteString(": ")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.Bytes()
+}
+
+func rawToBytes(docs []bson.Raw) [][]byte {
+	b := make([][]byte, len(docs))
+	for i, doc := range docs {
+		b[i] = doc
+	}
+	return b
+}
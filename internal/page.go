@@ -24,6 +24,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"time"
 )
 
 const (
@@ -44,8 +47,14 @@ const (
 	// max size of a playground. This value is the minimum we can
 	// set to avoid breaking already saved playground
 	maxByteSize = 350 * 1000
+	// max size of the body of a request to run or save a playground.
+	// Url encoding can triple the size of the config and of the query,
+	// for example '\x00' is encoded as '%00'
+	maxBodySize = 3*maxByteSize + 1000
 	// length of the id of a page. Do not change this value
 	pageIDLength = 11
+	// max number of ids tried to save a page, see page.alternateID()
+	maxAlternateIDs = 8
 )
 
 type page struct {
@@ -56,12 +65,15 @@ type page struct {
 	Query []byte
 	// mongodb version
 	MongoVersion []byte
+	// expiration date of an expiring playground, not saved
+	// with the page, see expiry.go
+	ExpiresAt time.Time
 }
 
 func newPage(modeName, config, query string) (*page, error) {
 
 	if (len(config) + len(query)) > maxByteSize {
-		return nil, errors.New(errPlaygroundToBig)
+		return nil, &playgroundError{kind: limitError, msg: errPlaygroundToBig}
 	}
 	mode := bsonMode
 	if modeName == mgodatagenLabel {
@@ -74,9 +86,88 @@ func newPage(modeName, config, query string) (*page, error) {
 	}, nil
 }
 
+// returned when the body of a request is bigger than maxBodySize
+var errBodyTooBig = &playgroundError{kind: limitError, msg: errPlaygroundToBig}
+
+// limitBody rejects a request with a body bigger than maxBodySize before
+// it's read. If the size of the body is unknown, reading more than
+// maxBodySize bytes from it fails with errBodyTooBig
+func limitBody(r *http.Request) error {
+	if r.ContentLength > maxBodySize {
+		return errBodyTooBig
+	}
+	if r.Body != nil {
+		r.Body = &limitedBody{ReadCloser: r.Body, remaining: maxBodySize}
+	}
+	return nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooBig
+	}
+	// read one more byte than allowed to detect bodies too big
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errBodyTooBig
+	}
+	return n, err
+}
+
+// parse the form of a request to run or save a playground, and
+// create the page from it. The body is limited to maxBodySize
+func newPageFromForm(r *http.Request) (*page, error) {
+
+	err := limitBody(r)
+	if err == nil {
+		err = r.ParseForm()
+	}
+	if errors.Is(err, errBodyTooBig) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newPlaygroundError(requestError, "invalid request: %v", err)
+	}
+	return newPage(
+		r.FormValue("mode"),
+		r.FormValue("config"),
+		r.FormValue("query"),
+	)
+}
+
+// write the error of newPageFromForm as plain text. Playgrounds too
+// big are rejected with a 413 status code, other errors are displayed
+// in the web page like an error in the query
+func writePageError(w http.ResponseWriter, err error) {
+	var pErr *playgroundError
+	if errors.As(err, &pErr) && pErr.kind == limitError {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}
+	w.Write([]byte(err.Error()))
+}
+
 // generate an unique id for this page
 func (p *page) ID() []byte {
+	return p.alternateID(0)
+}
+
+// generate the n-th id of this page. The first one is the id of the
+// page. As ids are truncated hashes, two pages can have the same id,
+// in which case the next alternate id is used
+func (p *page) alternateID(n int) []byte {
 	e := sha256.New()
+	if n > 0 {
+		fmt.Fprintf(e, "alternate-%d:", n)
+	}
 	e.Write([]byte{p.Mode})
 	e.Write(p.Query)
 	e.Write(p.Config)
@@ -87,32 +178,11 @@ func (p *page) ID() []byte {
 }
 
 // generate an unique hash to identify the database used by the p page. Two pages with
-// same config and mode should generate the same dbHash
+// same config and mode should generate the same dbHash.
+//
+// queries modifying the database, like update(), don't use this database, see
+// storage.run()
 func (p *page) dbHash() string {
-
-	// if the query is an update, the base collection will change, which can
-	// mess up things if a find() is run after an update() with the same config
-	// for example, when running the two following playgrounds successively
-	//
-	// {
-	//  "config": {"n": 1},
-	//  "query": "db.collection.update({},{"$set":{"updated":true}})"
-	// }
-	//
-	// {
-	//  "config": {"n": 1},
-	//  "query": "db.collection.find()"
-	// }
-	//
-	// output would be {"n": 1, "updated": true}, witch is incorrect for the
-	// second playground.
-	//
-	// to avoid this, add an extra byte when computing the hashsum, so the two above
-	// playgrounds get different database
-	if bytes.Contains(p.Query, []byte(".update(")) {
-		return fmt.Sprintf("%x", md5.Sum(append(p.Config, p.Mode, 0)))
-	}
-
 	return fmt.Sprintf("%x", md5.Sum(append(p.Config, p.Mode)))
 }
 
@@ -134,14 +204,67 @@ func (p *page) encode() []byte {
 	return v
 }
 
-// decode a slice of byte into the p page
+// returns the size of the page encoded with encode(), even if
+// its configuration is saved in a blob
+func (p *page) encodedSize() int {
+	return 5 + len(p.Config) + len(p.Query)
+}
+
+// encode a page whose configuration is saved in a separate blob
+// identified by ref, see config_blob.go
+//
+// v[0:4] -> 0. It can't be the position of the last byte of the configuration
+// in encode(), so both formats can be told apart
+// v[4] -> the mode (mgodatagen / bson) to use for building the database
+// v[5:5+configRefLength] -> the ref of the configuration blob
+// v[5+configRefLength:] -> the query
+func (p *page) encodeWithConfigRef(ref []byte) []byte {
+	v := make([]byte, 5+configRefLength+len(p.Query))
+
+	v[4] = p.Mode
+	copy(v[5:5+configRefLength], ref)
+	copy(v[5+configRefLength:], p.Query)
+	return v
+}
+
+// decode a slice of byte into the p page. If the page was encoded with
+// encodeWithConfigRef(), p.Config is nil and has to be loaded from the
+// blob returned by configRef()
 func (p *page) decode(v []byte) {
-	endConfig := binary.LittleEndian.Uint32(v[0:4])
 	p.Mode = v[4]
+	if configRef(v) != nil {
+		p.Config = nil
+		p.Query = v[5+configRefLength:]
+		return
+	}
+	endConfig := binary.LittleEndian.Uint32(v[0:4])
 	p.Config = v[5:endConfig]
 	p.Query = v[endConfig:]
 }
 
+// returns the ref of the configuration blob of an encoded page,
+// or nil if the configuration is part of the page
+func configRef(v []byte) []byte {
+	if binary.LittleEndian.Uint32(v[0:4]) != 0 {
+		return nil
+	}
+	return v[5 : 5+configRefLength]
+}
+
+// returns true if both pages have the same mode, config and query
+func (p *page) equal(other *page) bool {
+	return p.Mode == other.Mode && bytes.Equal(p.Config, other.Config) && bytes.Equal(p.Query, other.Query)
+}
+
+// returns the name of the main mode of the page, as sent
+// by the web page
+func (p *page) modeName() string {
+	if p.Mode == mgodatagenMode {
+		return mgodatagenLabel
+	}
+	return bsonLabel
+}
+
 // returns a label for the page for prometheus metrics
 func (p *page) label() string {
 
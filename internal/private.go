@@ -0,0 +1,198 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A private playground can only be viewed with the secret read token returned
+// when it's saved, like /p/Xq3k-Tz0aBc?token=..., and optionally with a
+// password. Its id is random, so it doesn't reveal its content and doesn't
+// collide with the public playground having the same content.
+//
+// The access rules of a private playground are saved in the playground
+// store with the key access/{id}, and are encoded as:
+//
+// v[0:32] -> the sha256 of the read token
+// v[32:] -> the bcrypt hash of the password, if any
+//
+// Private playgrounds are not counted in metrics, and are never listed
+// in the history of other playgrounds
+const (
+	accessPrefix = "access/"
+	// name of the query parameter holding the read token
+	tokenParam = "token"
+	// number of random bytes of a read token
+	readTokenSize = 32
+	// max number of random ids tried to save a private
+	// or an expiring playground
+	maxRandomIDAttempts = 8
+)
+
+var (
+	errInvalidToken    = errors.New("invalid read token")
+	errInvalidPassword = errors.New("invalid password")
+)
+
+func accessKey(id []byte) []byte {
+	return append([]byte(accessPrefix), id...)
+}
+
+// save the page as a private playground, expiring after ttl if it's not 0,
+// and return its random id and its read token
+func (s *storage) savePrivate(p *page, password string, ttl time.Duration) (id, token []byte, err error) {
+
+	token = make([]byte, base64.RawURLEncoding.EncodedLen(readTokenSize))
+	if err := randomURLSafe(token); err != nil {
+		return nil, nil, err
+	}
+	tokenHash := sha256.Sum256(token)
+	access := tokenHash[:]
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fail to hash password: %v", err)
+		}
+		access = append(access, hash...)
+	}
+
+	id, err = s.saveWithRandomID(p, access, ttl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to save private playground: %v", err)
+	}
+	return id, token, nil
+}
+
+// save the page with a random id, and return this id. If access is not
+// nil, the page is private and access holds its access rules. If ttl is
+// not 0, the page expires after ttl
+func (s *storage) saveWithRandomID(p *page, access []byte, ttl time.Duration) (id []byte, err error) {
+
+	// the configuration of an expiring page is kept in the page, as
+	// its reference to a blob would never be released
+	val, ref := p.encode(), []byte(nil)
+	if ttl == 0 {
+		val, ref, _, err = s.encodePage(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id = make([]byte, pageIDLength)
+	for i := 0; i < maxRandomIDAttempts; i++ {
+		if err = randomURLSafe(id); err != nil {
+			break
+		}
+		var inserted bool
+		inserted, err = s.saveRandomID(id, val, access, ttl)
+		if err == nil && inserted {
+			return id, nil
+		}
+	}
+	if err == nil {
+		err = errTooManyCollisions
+	}
+	if ref != nil {
+		if releaseErr := s.releaseConfigBlob(ref); releaseErr != nil {
+			log.Print(releaseErr)
+		}
+	}
+	return nil, err
+}
+
+func (s *storage) saveRandomID(id, val, access []byte, ttl time.Duration) (inserted bool, err error) {
+
+	// the access rules and the expiry are saved first, so the page is
+	// never readable without them. They outlive the page, so an expired
+	// private page is only reported as expired to its readers
+	var saved [][]byte
+	defer func() {
+		if !inserted {
+			for _, key := range saved {
+				s.store.delete(key)
+			}
+		}
+	}()
+	if access != nil {
+		inserted, err = s.store.putIfAbsentWithTTL(accessKey(id), access, expiryRecordTTL(ttl))
+		if err != nil || !inserted {
+			return false, err
+		}
+		saved = append(saved, accessKey(id))
+	}
+	if ttl > 0 {
+		inserted, err = s.recordExpiry(id, ttl)
+		if err != nil || !inserted {
+			return false, err
+		}
+		saved = append(saved, expiryKey(id))
+	}
+	return s.store.putIfAbsentWithTTL(id, val, ttl)
+}
+
+// returns true if the playground with this id is private
+func (s *storage) isPrivate(id []byte) bool {
+	_, err := s.store.get(accessKey(id))
+	return err == nil
+}
+
+// check that the request can read a playground with this access record,
+// nil for a public playground. Public playgrounds can always be read.
+// Private ones need the read token in the url, and the password as basic
+// auth if there's one
+func checkAccess(r *http.Request, access []byte) error {
+
+	if access == nil {
+		return nil
+	}
+
+	tokenHash := sha256.Sum256([]byte(r.URL.Query().Get(tokenParam)))
+	if subtle.ConstantTimeCompare(tokenHash[:], access[:sha256.Size]) != 1 {
+		return errInvalidToken
+	}
+
+	passwordHash := access[sha256.Size:]
+	if len(passwordHash) == 0 {
+		return nil
+	}
+	_, password, _ := r.BasicAuth()
+	if bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) != nil {
+		return errInvalidPassword
+	}
+	return nil
+}
+
+// fill b with random base64 url chars
+func randomURLSafe(b []byte) error {
+	random := make([]byte, base64.RawURLEncoding.DecodedLen(len(b))+1)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Errorf("fail to generate random bytes: %v", err)
+	}
+	copy(b, base64.RawURLEncoding.EncodeToString(random))
+	return nil
+}
@@ -0,0 +1,130 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrivatePlayground(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{store: newMemoryStore()}
+
+	public := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()"}`)
+	private := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Private":true,"Parent":"`+public.ID+`"}`)
+	protected := saveWithAPI(t, s, `{"Mode":"bson","Config":"[{}]","Query":"db.collection.find()","Private":true,"Password":"secret"}`)
+
+	if private.Token == "" || private.ID == public.ID || private.ID == protected.ID {
+		t.Fatalf("private playgrounds should have a random id and a token, got %+v", private)
+	}
+	if want := playgroundURL(httptest.NewRequest(http.MethodGet, "/", nil), []byte(private.ID)) + "?token=" + private.Token; want != private.URL {
+		t.Errorf("expected url %s but got %s", want, private.URL)
+	}
+
+	viewTests := []struct {
+		name         string
+		url          string
+		password     string
+		responseCode int
+	}{
+		{
+			name:         "public playground",
+			url:          "/p/" + public.ID + jsonExportSuffix,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "private playground without token",
+			url:          "/p/" + private.ID + jsonExportSuffix,
+			responseCode: http.StatusNotFound,
+		},
+		{
+			name:         "private playground with invalid token",
+			url:          "/p/" + private.ID + queryExportSuffix + "?token=" + protected.Token,
+			responseCode: http.StatusNotFound,
+		},
+		{
+			name:         "private playground with token",
+			url:          "/p/" + private.ID + queryExportSuffix + "?token=" + private.Token,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "protected playground without password",
+			url:          "/p/" + protected.ID + jsonExportSuffix + "?token=" + protected.Token,
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "protected playground with invalid password",
+			url:          "/p/" + protected.ID + jsonExportSuffix + "?token=" + protected.Token,
+			password:     "invalid",
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "protected playground with password",
+			url:          "/p/" + protected.ID + jsonExportSuffix + "?token=" + protected.Token,
+			password:     "secret",
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "diff with a private playground",
+			url:          "/p/" + public.ID + diffSuffix + private.ID + "?token=" + private.Token,
+			responseCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range viewTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.password != "" {
+				req.SetBasicAuth("", tt.password)
+			}
+			resp := httptest.NewRecorder()
+			s.viewHandler(resp, req)
+
+			if want, got := tt.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d", want, got)
+			}
+		})
+	}
+
+	// private playgrounds are not listed in the history of other playgrounds
+	history, _ := s.history([]byte(public.ID))
+	if len(history.Forks) != 0 {
+		t.Errorf("private playground should not be listed as a fork, got %v", history.Forks)
+	}
+
+	if _, err := s.reserveSlug([]byte("private-demo"), []byte(private.ID)); err == nil {
+		t.Errorf("slugs should not be reserved for private playgrounds")
+	}
+}
+
+func saveWithAPI(t *testing.T, s *storage, body string) (saved apiSaveResponse) {
+
+	resp := httptest.NewRecorder()
+	s.apiSaveHandler(resp, httptest.NewRequest(http.MethodPost, apiSaveEndpoint, strings.NewReader(body)))
+
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("fail to save playground: %d %s", resp.Code, resp.Body)
+	}
+	json.Unmarshal(resp.Body.Bytes(), &saved)
+	return saved
+}
@@ -0,0 +1,242 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// interval between two removal of idle buckets
+	bucketPruneInterval = time.Minute
+
+	errTooManyRequests = "too many requests, retry in a few seconds"
+)
+
+// RateLimit is the number of requests a single client
+// can send to an endpoint
+type RateLimit struct {
+	// average number of requests allowed per minute
+	RequestsPerMinute int
+	// max number of requests that can be sent at once
+	Burst int
+}
+
+// rateLimiter throttles the clients with a token bucket per
+// client ip and per endpoint
+type rateLimiter struct {
+	limits         map[string]RateLimit
+	trustedProxies []*net.IPNet
+	allowList      []*net.IPNet
+
+	// lock guards the fields below
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limits map[string]RateLimit, trustedProxies, allowList []string) (*rateLimiter, error) {
+
+	proxies, err := parseNetworks(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	allowed, err := parseNetworks(allowList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit allow-list: %v", err)
+	}
+
+	// limits are copied, so the defaults don't change the caller's map
+	endpointLimits := make(map[string]RateLimit, len(limits))
+	for endpoint, limit := range limits {
+		if limit.RequestsPerMinute <= 0 {
+			return nil, fmt.Errorf("invalid rate limit for %s: requests per minute must be positive", endpoint)
+		}
+		if limit.Burst <= 0 {
+			limit.Burst = 1
+		}
+		endpointLimits[endpoint] = limit
+	}
+
+	return &rateLimiter{
+		limits:         endpointLimits,
+		trustedProxies: proxies,
+		allowList:      allowed,
+		buckets:        map[string]*tokenBucket{},
+		lastPrune:      time.Now(),
+	}, nil
+}
+
+// parse a list of ip or CIDR, like "10.0.0.1" or "10.0.0.0/8"
+func parseNetworks(addrs []string) ([]*net.IPNet, error) {
+
+	networks := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is not a valid ip", addr)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			addr = fmt.Sprintf("%s/%d", addr, bits)
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware handler rejecting requests from clients exceeding the
+// rate limit of an endpoint with a 429 status code
+func rateLimit(handler http.Handler, limiter *rateLimiter) http.Handler {
+
+	if len(limiter.limits) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		limit, ok := limiter.limits[r.URL.Path]
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ip := limiter.clientIP(r)
+		if ip == nil || containsIP(limiter.allowList, ip) || limiter.allow(r.URL.Path+" "+ip.String(), limit, time.Now()) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		rateLimitedCounter.WithLabelValues(r.URL.Path).Inc()
+
+		retryAfter := int(time.Minute.Seconds())/limit.RequestsPerMinute + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, &playgroundError{kind: rateLimitError, msg: errTooManyRequests})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(errTooManyRequests))
+	})
+}
+
+// ip of the client that sent the request. X-Forwarded-For is only
+// used if the request comes from a trusted proxy, and the client is
+// the first address not belonging to a trusted proxy starting from
+// the right, as the leftmost addresses can be set by the client
+func (l *rateLimiter) clientIP(r *http.Request) net.IP {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(l.trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !containsIP(l.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// take a token from the bucket identified by key. Returns
+// false if the bucket is empty
+func (l *rateLimiter) allow(key string, limit RateLimit, now time.Time) bool {
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPrune) > bucketPruneInterval {
+		l.pruneBuckets(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+
+	refill := now.Sub(bucket.last).Minutes() * float64(limit.RequestsPerMinute)
+	bucket.tokens = minFloat(bucket.tokens+refill, float64(limit.Burst))
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// remove buckets that would be full by now, as they behave
+// like a new bucket. Caller must hold the lock
+func (l *rateLimiter) pruneBuckets(now time.Time) {
+
+	for key, bucket := range l.buckets {
+		limit := l.limits[key[:strings.Index(key, " ")]]
+		refill := now.Sub(bucket.last).Minutes() * float64(limit.RequestsPerMinute)
+		if bucket.tokens+refill >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
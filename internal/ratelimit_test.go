@@ -0,0 +1,260 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+
+	t.Parallel()
+
+	limits := map[string]RateLimit{
+		saveEndpoint:    {RequestsPerMinute: 1, Burst: 2},
+		apiSaveEndpoint: {RequestsPerMinute: 1, Burst: 1},
+	}
+	limiter, err := newRateLimiter(limits, []string{"10.0.0.0/8"}, []string{"192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), limiter)
+
+	rateLimitTests := []struct {
+		name         string
+		endpoint     string
+		remoteAddr   string
+		forwardedFor string
+		nbRequests   int
+		nbAccepted   int
+		rejectedCode int
+		rejectedType string
+	}{
+		{
+			name:         "burst then rejected",
+			endpoint:     saveEndpoint,
+			remoteAddr:   "192.0.2.1:1234",
+			nbRequests:   4,
+			nbAccepted:   2,
+			rejectedCode: http.StatusTooManyRequests,
+			rejectedType: "text/plain; charset=utf-8",
+		},
+		{
+			name:         "api endpoint",
+			endpoint:     apiSaveEndpoint,
+			remoteAddr:   "192.0.2.2:1234",
+			nbRequests:   2,
+			nbAccepted:   1,
+			rejectedCode: http.StatusTooManyRequests,
+			rejectedType: "application/json; charset=utf-8",
+		},
+		{
+			name:       "endpoint without limit",
+			endpoint:   runEndpoint,
+			remoteAddr: "192.0.2.3:1234",
+			nbRequests: 10,
+			nbAccepted: 10,
+		},
+		{
+			name:       "allow-listed client",
+			endpoint:   saveEndpoint,
+			remoteAddr: "192.0.2.10:1234",
+			nbRequests: 10,
+			nbAccepted: 10,
+		},
+		{
+			name:         "allow-listed client behind trusted proxy",
+			endpoint:     saveEndpoint,
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: "192.0.2.10",
+			nbRequests:   10,
+			nbAccepted:   10,
+		},
+		{
+			name:         "X-Forwarded-For ignored from untrusted proxy",
+			endpoint:     saveEndpoint,
+			remoteAddr:   "192.0.2.4:1234",
+			forwardedFor: "192.0.2.10",
+			nbRequests:   3,
+			nbAccepted:   2,
+			rejectedCode: http.StatusTooManyRequests,
+			rejectedType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, tt := range rateLimitTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			accepted := 0
+			for i := 0; i < test.nbRequests; i++ {
+
+				req := httptest.NewRequest(http.MethodPost, test.endpoint, nil)
+				req.RemoteAddr = test.remoteAddr
+				if test.forwardedFor != "" {
+					req.Header.Set("X-Forwarded-For", test.forwardedFor)
+				}
+				resp := httptest.NewRecorder()
+				handler.ServeHTTP(resp, req)
+
+				if resp.Code == http.StatusOK {
+					accepted++
+					continue
+				}
+				if want, got := test.rejectedCode, resp.Code; want != got {
+					t.Errorf("expected response code %d but got %d", want, got)
+				}
+				if want, got := test.rejectedType, resp.Header().Get("Content-Type"); want != got {
+					t.Errorf("expected Content-Type %s but got %s", want, got)
+				}
+				if resp.Header().Get("Retry-After") == "" {
+					t.Errorf("Retry-After header should be set")
+				}
+			}
+			if want, got := test.nbAccepted, accepted; want != got {
+				t.Errorf("expected %d accepted requests but got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+
+	t.Parallel()
+
+	limiter, _ := newRateLimiter(nil, []string{"10.0.0.0/8", "172.16.0.1"}, nil)
+
+	clientIPTests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		clientIP     string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "192.0.2.1:1234",
+			clientIP:   "192.0.2.1",
+		},
+		{
+			name:         "untrusted proxy",
+			remoteAddr:   "192.0.2.1:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			clientIP:     "192.0.2.1",
+		},
+		{
+			name:         "trusted proxy",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: []string{"198.51.100.1"},
+			clientIP:     "198.51.100.1",
+		},
+		{
+			name:         "spoofed header behind trusted proxies",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: []string{"203.0.113.1, 198.51.100.1, 172.16.0.1"},
+			clientIP:     "198.51.100.1",
+		},
+		{
+			name:         "multiple headers",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: []string{"203.0.113.1", "198.51.100.1"},
+			clientIP:     "198.51.100.1",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "10.0.0.1:1234",
+			clientIP:   "10.0.0.1",
+		},
+	}
+
+	for _, tt := range clientIPTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodPost, saveEndpoint, nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, header := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+
+			if want, got := test.clientIP, limiter.clientIP(req).String(); want != got {
+				t.Errorf("expected client ip %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+
+	t.Parallel()
+
+	limit := RateLimit{RequestsPerMinute: 60, Burst: 1}
+	limiter, _ := newRateLimiter(map[string]RateLimit{saveEndpoint: limit}, nil, nil)
+
+	now := time.Now()
+	key := saveEndpoint + " 192.0.2.1"
+
+	if !limiter.allow(key, limit, now) {
+		t.Errorf("first request should be allowed")
+	}
+	if limiter.allow(key, limit, now.Add(500*time.Millisecond)) {
+		t.Errorf("bucket should be empty")
+	}
+	if !limiter.allow(key, limit, now.Add(1100*time.Millisecond)) {
+		t.Errorf("bucket should have been refilled")
+	}
+
+	// full buckets are removed
+	limiter.pruneBuckets(now.Add(time.Hour))
+	if want, got := 0, len(limiter.buckets); want != got {
+		t.Errorf("expected %d buckets but got %d", want, got)
+	}
+}
+
+func TestRateLimitDefaultBurst(t *testing.T) {
+
+	t.Parallel()
+
+	limits := map[string]RateLimit{saveEndpoint: {RequestsPerMinute: 60}}
+	limiter, _ := newRateLimiter(limits, nil, nil)
+
+	if want, got := 1, limiter.limits[saveEndpoint].Burst; want != got {
+		t.Errorf("expected a burst of %d but got %d", want, got)
+	}
+	if want, got := 0, limits[saveEndpoint].Burst; want != got {
+		t.Errorf("the limits passed to the limiter should not be modified, got a burst of %d", got)
+	}
+}
+
+func TestInvalidRateLimitConfig(t *testing.T) {
+
+	t.Parallel()
+
+	if _, err := newRateLimiter(nil, []string{"not an ip"}, nil); err == nil {
+		t.Errorf("invalid trusted proxy should return an error")
+	}
+	if _, err := newRateLimiter(nil, nil, []string{"10.0.0.0/99"}); err == nil {
+		t.Errorf("invalid allow-list should return an error")
+	}
+	if _, err := newRateLimiter(map[string]RateLimit{saveEndpoint: {}}, nil, nil); err == nil {
+		t.Errorf("rate limit without requests per minute should return an error")
+	}
+}
@@ -19,10 +19,14 @@ package internal
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/feliixx/mgodatagen/datagen"
@@ -43,6 +47,16 @@ const (
 	maxDoc = 100
 	// max time a query can run before being aborted by the Server
 	maxQueryTime = writeTimeout - readTimeout
+	// default max size in bytes of the documents returned by a query
+	defaultResultSizeLimit = 4 * 1000 * 1000
+	// number of documents to fetch per getMore
+	getMoreBatchSize = 1000
+	// max time spent killing a cursor not read until the end
+	killCursorTimeout = 5 * time.Second
+	// status of the ephemeral databases, see ephemeralDatabasesCounter
+	ephemeralDBCreated    = "created"
+	ephemeralDBFailed     = "failed"
+	ephemeralDBDropFailed = "drop_failed"
 	// errInvalidConfig error message when the configuration doesn't match expected format
 	errInvalidConfig = `expecting an array of documents like 
 
@@ -69,23 +83,112 @@ db = {
 	findMethod      = "find"
 	aggregateMethod = "aggregate"
 	updateMethod    = "update"
+
+	// kinds of error that can be returned when running a playground
+	configError    = "config"
+	queryError     = "query"
+	executionError = "execution"
+	limitError     = "limit"
+	// the body of an api request can't be decoded
+	requestError = "request"
+	// too many queries are already running or waiting
+	busyError = "busy"
+	// the client sent too many requests
+	rateLimitError = "rate_limit"
+	// the request lacks a valid token
+	authError = "auth"
+	// the playground referenced by the request doesn't exist
+	notFoundError = "not_found"
+	// the request conflicts with an existing resource, like a slug
+	conflictError = "conflict"
 )
 
+// playgroundError is returned when a playground can't be run or saved.
+// Its kind tells whether the configuration, the query or the
+// execution itself is at fault
+type playgroundError struct {
+	kind string
+	msg  string
+}
+
+func newPlaygroundError(kind, format string, a ...interface{}) *playgroundError {
+	return &playgroundError{
+		kind: kind,
+		msg:  fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *playgroundError) Error() string {
+	return e.msg
+}
+
+// http status code matching the kind of error
+func (e *playgroundError) statusCode() int {
+	switch e.kind {
+	case configError, queryError, requestError:
+		return http.StatusBadRequest
+	case limitError:
+		return http.StatusRequestEntityTooLarge
+	case executionError:
+		return http.StatusUnprocessableEntity
+	case busyError:
+		return http.StatusServiceUnavailable
+	case rateLimitError:
+		return http.StatusTooManyRequests
+	case authError:
+		return http.StatusUnauthorized
+	case notFoundError:
+		return http.StatusNotFound
+	case conflictError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// runResult holds the output of a playground along with
+// some info on the query that produced it
+type runResult struct {
+	// documents returned by the query. In explain mode, holds
+	// a single document with the explain output
+	docs        []bson.Raw
+	collection  string
+	method      string
+	explainMode string
+	// number of documents returned. Always 0 in explain mode
+	docCount int
+	// number of documents produced by the query, including the ones
+	// that were not returned because of the size limit. If the result
+	// is truncated, the remaining batches are not fetched, so it's only
+	// a lower bound
+	totalCount int
+	// true if some documents were not returned
+	truncated bool
+	// true if the result comes from the result cache
+	cached bool
+}
+
 // run a query and return the results as plain text.
-// the result is compacted and looks like:
+// by default, the result is compacted and looks like:
 //
 //    [{_id:1,k:1},{_id:2,k:33}]
+//
+// another format can be chosen with the 'output' parameter, see output.go
 func (s *storage) runHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	p, err := newPage(
-		r.FormValue("mode"),
-		r.FormValue("config"),
-		r.FormValue("query"),
-	)
+	p, err := newPageFromForm(r)
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writePageError(w, err)
+		return
+	}
+
+	output := r.FormValue("output")
+	if output == "" {
+		output = shellOutput
+	}
+	if !isValidOutput(output) {
+		w.Write([]byte(errInvalidOutput))
 		return
 	}
 
@@ -94,77 +197,247 @@ func (s *storage) runHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	w.Write(res)
+	// the truncation is reported in headers rather than in the body, so
+	// the result can still be indented. The web page shows a notice after
+	// the result when X-Result-Truncated is true, using the counts from
+	// X-Result-Count and X-Result-Total
+	w.Header().Set("X-Result-Count", strconv.Itoa(res.docCount))
+	w.Header().Set("X-Result-Total", strconv.Itoa(res.totalCount))
+	w.Header().Set("X-Result-Truncated", strconv.FormatBool(res.truncated))
+
+	if output == shellOutput && res.docCount == 0 && res.explainMode == "" {
+		w.Write([]byte(noDocFound))
+		return
+	}
+
+	b, err := res.format(output)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	setOutputHeaders(w, output)
+	w.Write(b)
 }
 
-func (s *storage) run(context context.Context, p *page) ([]byte, error) {
+func (s *storage) run(context context.Context, p *page) (*runResult, error) {
 
 	collectionName, method, stages, explainMode, err := parseQuery(p.Query)
 	if err != nil {
-		return nil, fmt.Errorf("error in query:\n  %v", err)
+		return nil, newPlaygroundError(queryError, "error in query:\n  %v", err)
 	}
 
-	db := s.mongoSession.Database(p.dbHash())
+	// results of read-only queries don't change as long as the
+	// playground and the version of MongoDB are the same
+	cacheable := isCacheable(p, method)
+	cacheKey := resultCacheKey(p, s.mongoVersion())
+	if cacheable {
+		if res, ok := s.resultCache.get(cacheKey); ok {
+			return res, nil
+		}
+	}
 
-	// if this is an 'update' query, always re-create the database,
-	// run the update and return the result of a 'find' query on the
-	// same collection
-	forceCreate := method == updateMethod
-	dbInfos, err := s.createDatabase(db, p.Mode, p.Config, forceCreate)
+	release, err := s.runLimiter.acquire(context)
 	if err != nil {
-		return nil, fmt.Errorf("error in configuration:\n  %v", err)
+		return nil, err
+	}
+	defer release()
+
+	var db *mongo.Database
+	var dbInfos dbMetaInfo
+
+	// queries modifying the database run in their own database, created for
+	// this request only and dropped right after. This way, two users running
+	// the same update at the same time can't see each other's changes.
+	// Other queries share a database with all playgrounds having the same config
+	if isWriteMethod(method) {
+		db = s.mongoSession.Database(ephemeralDBName())
+		defer dropEphemeralDB(db)
+
+		dbInfos, err = createDBFromConfig(db, p.Mode, p.Config)
+		if err != nil {
+			ephemeralDatabasesCounter.WithLabelValues(ephemeralDBFailed).Inc()
+		} else {
+			ephemeralDatabasesCounter.WithLabelValues(ephemeralDBCreated).Inc()
+		}
+	} else {
+		db = s.mongoSession.Database(p.dbHash())
+		dbInfos, err = s.createDatabase(context, db, p.Mode, p.Config)
+		if err == nil {
+			defer s.releaseDatabase(db.Name())
+		}
+	}
+	if err != nil {
+		// the request timed out while waiting for the database
+		var pErr *playgroundError
+		if errors.As(err, &pErr) {
+			return nil, err
+		}
+		return nil, newPlaygroundError(configError, "error in configuration:\n  %v", err)
 	}
 
 	// mongodb returns an empty array ( [] ) if we try to run a query on a collection
 	// that doesn't exist. Check that the collection exist before running the query,
 	// to return a clear error message in that case
 	if !dbInfos.hasCollection(collectionName) {
-		return nil, fmt.Errorf(`collection "%s" doesn't exist`, collectionName)
+		return nil, newPlaygroundError(queryError, `collection "%s" doesn't exist`, collectionName)
 	}
-	return runQuery(context, db.Collection(collectionName), method, stages, explainMode)
+
+	res, err := runQuery(context, db.Collection(collectionName), method, stages, explainMode, s.resultSizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	res.collection = collectionName
+	res.method = method
+	res.explainMode = explainMode
+
+	if cacheable {
+		s.resultCache.add(cacheKey, res)
+	}
+	return res, nil
+}
+
+// dbCreation tracks the creation of a database. Requests needing a
+// database being created wait for done to be closed, and then share
+// the result
+type dbCreation struct {
+	done   chan struct{}
+	dbInfo dbMetaInfo
+	err    error
 }
 
-func (s *storage) createDatabase(db *mongo.Database, mode byte, config []byte, forceCreate bool) (dbInfo dbMetaInfo, err error) {
+// create the database if it's not already in activeDB. Only one request at
+// a time can create a given database: concurrent requests for the same database
+// wait for the creation to complete, while requests for other databases are
+// not blocked. A database being dropped after its eviction is created again
+// once the drop completes.
+//
+// If no error is returned, the database is in use by the request until
+// releaseDatabase() is called, so it can't be evicted
+func (s *storage) createDatabase(ctx context.Context, db *mongo.Database, mode byte, config []byte) (dbMetaInfo, error) {
 
 	s.activeDbLock.Lock()
-	defer s.activeDbLock.Unlock()
 
 	dbInfo, exists := s.activeDB[db.Name()]
-	if !exists || forceCreate {
+	if exists {
+		dbInfo.lastUsed = time.Now().Unix()
+		saveLastUsed := time.Duration(dbInfo.lastUsed-dbInfo.lastSaved)*time.Second >= lastUsedSaveInterval
+		if saveLastUsed {
+			dbInfo.lastSaved = dbInfo.lastUsed
+		}
+		s.activeDB[db.Name()] = dbInfo
+		s.dbUsers[db.Name()]++
+		s.activeDbLock.Unlock()
 
-		switch mode {
-		case mgodatagenMode:
-			dbInfo, err = createDBFromMgodatagen(db, config)
-		case bsonMode:
-			dbInfo, err = createDBFromJSON(db, config)
+		if saveLastUsed {
+			s.saveDBLastUsed(db.Name(), dbInfo.lastUsed)
 		}
-		if err != nil {
-			return dbInfo, err
+		return dbInfo, nil
+	}
+
+	if inProgress, ok := s.dbCreations[db.Name()]; ok {
+		s.activeDbLock.Unlock()
+		select {
+		case <-inProgress.done:
+		case <-ctx.Done():
+			return dbMetaInfo{}, &playgroundError{kind: busyError, msg: errServerBusy}
 		}
+		if inProgress.err == nil {
+			s.activeDbLock.Lock()
+			s.dbUsers[db.Name()]++
+			s.activeDbLock.Unlock()
+		}
+		return inProgress.dbInfo, inProgress.err
+	}
 
-		// if the database is empty, ie all collections contains no document,
-		// we do not add the database to the activeDB map and just return
-		// directly
-		//
-		// if the database is empty, but it's an update (ie 'forceCreate' is true),
-		// it might be an upsert which would create a database, so in doubt add the
-		// database to the activeDB map
-		//
-		// if the database was already present ( for example, if an user run the
-		// exact same update query twice ), but is re-created because 'forceCreate'
-		// is true, it's already in the activeDB map, we return directly to avoid
-		// incrementing the 'activeDatabase' counter. 'lastUsed' access is not updated,
-		// but it doesn't matter because db is re-created every time
-		if (dbInfo.emptyDatabase && !forceCreate) || (exists && forceCreate) {
-			return dbInfo, nil
+	if dropping, ok := s.dbDrops[db.Name()]; ok {
+		s.activeDbLock.Unlock()
+		select {
+		case <-dropping:
+			return s.createDatabase(ctx, db, mode, config)
+		case <-ctx.Done():
+			return dbMetaInfo{}, &playgroundError{kind: busyError, msg: errServerBusy}
 		}
+	}
+
+	creation := &dbCreation{done: make(chan struct{})}
+	s.dbCreations[db.Name()] = creation
+	s.activeDbLock.Unlock()
+
+	dbInfo, err := createDBFromConfig(db, mode, config)
+	if err == nil && !dbInfo.emptyDatabase {
+		dbInfo.size = databaseSize(db)
+	}
+
+	s.activeDbLock.Lock()
+	// if the database is empty, ie all collections contains no document,
+	// we do not add the database to the activeDB map
+	added := err == nil && !dbInfo.emptyDatabase
+	if added {
+		dbInfo.lastUsed = time.Now().Unix()
+		dbInfo.lastSaved = dbInfo.lastUsed
+		s.activeDB[db.Name()] = dbInfo
+		delete(s.orphanDB, db.Name())
 		activeDatabasesCounter.Inc()
 	}
+	if err == nil {
+		s.dbUsers[db.Name()]++
+	}
+	delete(s.dbCreations, db.Name())
+	s.activeDbLock.Unlock()
 
-	dbInfo.lastUsed = time.Now().Unix()
-	s.activeDB[db.Name()] = dbInfo
+	creation.dbInfo, creation.err = dbInfo, err
+	close(creation.done)
 
-	return dbInfo, nil
+	// save the info so the database can be reused after a restart, and
+	// make room for it if there are too many databases
+	if added {
+		s.saveDBMetaInfo(db.Name(), dbInfo)
+		s.evictDatabases(db.Name())
+	}
+
+	return dbInfo, err
+}
+
+// release a database returned by createDatabase(), once
+// the request doesn't query it anymore
+func (s *storage) releaseDatabase(name string) {
+	s.activeDbLock.Lock()
+	s.dbUsers[name]--
+	if s.dbUsers[name] <= 0 {
+		delete(s.dbUsers, name)
+	}
+	s.activeDbLock.Unlock()
+}
+
+func createDBFromConfig(db *mongo.Database, mode byte, config []byte) (dbInfo dbMetaInfo, err error) {
+	switch mode {
+	case mgodatagenMode:
+		return createDBFromMgodatagen(db, config)
+	case bsonMode:
+		return createDBFromJSON(db, config)
+	}
+	return dbInfo, fmt.Errorf("invalid mode: %d", mode)
+}
+
+// returns true if the method modifies the database
+func isWriteMethod(method string) bool {
+	return method == updateMethod
+}
+
+// random name for a database used by a single request. Like databases
+// named after a dbHash, it's 32 char long, so it's removed by deleteExistingDB
+// if it's leaked
+func ephemeralDBName() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func dropEphemeralDB(db *mongo.Database) {
+	if err := db.Drop(context.Background()); err != nil {
+		log.Printf("fail to drop ephemeral database %s: %v", db.Name(), err)
+		ephemeralDatabasesCounter.WithLabelValues(ephemeralDBDropFailed).Inc()
+	}
 }
 
 func createDBFromMgodatagen(db *mongo.Database, config []byte) (dbInfo dbMetaInfo, err error) {
@@ -455,7 +728,7 @@ func unmarshalStages(queryBytes []byte) (stages []interface{}, err error) {
 	return stages, err
 }
 
-func runQuery(context context.Context, collection *mongo.Collection, method string, stages []interface{}, explainMode string) ([]byte, error) {
+func runQuery(context context.Context, collection *mongo.Collection, method string, stages []interface{}, explainMode string, sizeLimit int) (*runResult, error) {
 
 	var cmd bson.D
 
@@ -465,7 +738,7 @@ func runQuery(context context.Context, collection *mongo.Collection, method stri
 		cmd = bson.D{
 			{Key: aggregateMethod, Value: collection.Name()},
 			{Key: "pipeline", Value: sanitize(stages)},
-			{Key: "cursor", Value: bson.M{"batchSize": 1000}},
+			{Key: "cursor", Value: bson.M{"batchSize": getMoreBatchSize}},
 		}
 
 	case findMethod:
@@ -494,7 +767,7 @@ func runQuery(context context.Context, collection *mongo.Collection, method stri
 			_, err = collection.UpdateOne(context, stages[0], stages[1], opts)
 		}
 		if err != nil {
-			return nil, fmt.Errorf("fail to run update: %v", err)
+			return nil, newPlaygroundError(executionError, "fail to run update: %v", err)
 		}
 
 		cmd = bson.D{
@@ -503,7 +776,7 @@ func runQuery(context context.Context, collection *mongo.Collection, method stri
 		}
 
 	default:
-		return nil, fmt.Errorf("invalid method: '%s'", method)
+		return nil, newPlaygroundError(queryError, "invalid method: '%s'", method)
 	}
 
 	// make sure that all types of queries have a timeout,
@@ -521,30 +794,125 @@ func runQuery(context context.Context, collection *mongo.Collection, method stri
 
 	res := collection.Database().RunCommand(context, cmd)
 	if res.Err() != nil {
-		return nil, fmt.Errorf("query failed: %v", res.Err())
+		return nil, newPlaygroundError(executionError, "query failed: %v", res.Err())
 	}
 
-	var cursorDoc bson.M
-	if err := res.Decode(&cursorDoc); err != nil {
-		return nil, fmt.Errorf("fail to get result from cursor: %v", err)
+	raw, err := res.DecodeBytes()
+	if err != nil {
+		return nil, newPlaygroundError(executionError, "fail to get result from cursor: %v", err)
 	}
 
 	if explainMode != "" {
-		// not really sensitive, but it's useless as the server version already appears
-		// in the footer of the site, so just remove it
-		delete(cursorDoc, "serverInfo")
-		delete(cursorDoc, "ok")
+		explain, err := stripServerInfo(raw)
+		if err != nil {
+			return nil, newPlaygroundError(executionError, "fail to read explain output: %v", err)
+		}
+		return &runResult{docs: []bson.Raw{explain}}, nil
+	}
+	return readCursor(context, collection, raw, sizeLimit)
+}
+
+// read the batches of a cursor until sizeLimit is reached. The remaining
+// batches are not fetched and the cursor is killed, so totalCount is only
+// a lower bound of the number of documents when the result is truncated.
+//
+// the first result doc looks like
+//
+// {"cursor":{"firstBatch":[{"_id":1},{"_id":2}],"id":NumberLong(0),"ns":"dbName.collection"},"ok":1}
+//
+// and the following ones, returned by getMore, like
+//
+// {"cursor":{"nextBatch":[{"_id":3}],"id":NumberLong(0),"ns":"dbName.collection"},"ok":1}
+func readCursor(context context.Context, collection *mongo.Collection, raw bson.Raw, sizeLimit int) (*runResult, error) {
+
+	result := &runResult{}
+	size := 0
+	batchName := "firstBatch"
+
+	// the cursor is left open on the server if it's
+	// not read until the end, so kill it
+	var cursorID int64
+	defer func() {
+		if cursorID != 0 {
+			killCursor(collection, cursorID)
+		}
+	}()
+
+	for {
+		cursorID, _ = raw.Lookup("cursor", "id").Int64OK()
 
-		return mongoextjson.Marshal(cursorDoc)
+		batch, ok := raw.Lookup("cursor", batchName).ArrayOK()
+		if !ok {
+			return nil, newPlaygroundError(executionError, "fail to get result from cursor: no %s in response", batchName)
+		}
+		values, err := batch.Values()
+		if err != nil {
+			return nil, newPlaygroundError(executionError, "fail to get result from cursor: %v", err)
+		}
+		for _, v := range values {
+			result.totalCount++
+			if result.truncated || size+len(v.Value) > sizeLimit {
+				result.truncated = true
+				continue
+			}
+			size += len(v.Value)
+			result.docs = append(result.docs, v.Document())
+		}
+
+		if cursorID == 0 || result.truncated {
+			break
+		}
+
+		res := collection.Database().RunCommand(context, bson.D{
+			{Key: "getMore", Value: cursorID},
+			{Key: "collection", Value: collection.Name()},
+			{Key: "batchSize", Value: getMoreBatchSize},
+		})
+		if res.Err() != nil {
+			return nil, newPlaygroundError(executionError, "query failed: %v", res.Err())
+		}
+		raw, err = res.DecodeBytes()
+		if err != nil {
+			return nil, newPlaygroundError(executionError, "fail to get result from cursor: %v", err)
+		}
+		batchName = "nextBatch"
+	}
+
+	result.docCount = len(result.docs)
+	return result, nil
+}
+
+// kill a cursor not read until the end. The context of the request may
+// be done already, so the cursor is killed with its own timeout
+func killCursor(collection *mongo.Collection, cursorID int64) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), killCursorTimeout)
+	defer cancel()
+
+	err := collection.Database().RunCommand(ctx, bson.D{
+		{Key: "killCursors", Value: collection.Name()},
+		{Key: "cursors", Value: bson.A{cursorID}},
+	}).Err()
+	if err != nil {
+		log.Printf("fail to kill cursor %d on %s: %v", cursorID, collection.Name(), err)
 	}
-	// result doc looks like
-	//
-	// {"cursor":{"firstBatch":[{"_id":1},{"_id":2}],"id":NumberLong(0),"ns":"dbName.collection"},"ok":1}
-	docs := cursorDoc["cursor"].(bson.M)["firstBatch"].(bson.A)
-	if len(docs) == 0 {
-		return []byte(noDocFound), nil
+}
+
+// not really sensitive, but it's useless as the server version already appears
+// in the footer of the site, so just remove it
+func stripServerInfo(explain bson.Raw) (bson.Raw, error) {
+
+	var doc bson.D
+	if err := bson.Unmarshal(explain, &doc); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(doc); i++ {
+		if doc[i].Key == "serverInfo" || doc[i].Key == "ok" {
+			doc = append(doc[:i], doc[i+1:]...)
+			i--
+		}
 	}
-	return mongoextjson.Marshal(docs)
+	return bson.Marshal(doc)
 }
 
 func parseUpdateOpts(opts interface{}) (bool, *options.UpdateOptions) {
@@ -17,10 +17,17 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestRunCreateDB(t *testing.T) {
@@ -518,7 +525,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({"k":3}, {"$set": {"k":0}}, {"multi": false})`},
 			},
 			result:    `[{"_id":1,"k":0},{"_id":2,"k":3}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `basic update many`,
@@ -528,7 +535,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({}, {"$inc": {"n":10}}, {"multi": true})`},
 			},
 			result:    `[{"_id":1,"n":15},{"_id":2,"n":12}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `update without option`,
@@ -538,7 +545,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({}, {"$rename": {"name":"new"}})`},
 			},
 			result:    `[{"_id":1,"new":"ke"},{"_id":2,"name":"lme"}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `update with upsert`,
@@ -548,7 +555,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({"field":2}, {"$set": {"_id":2}}, {"upsert": true})`},
 			},
 			result:    `[{"_id":ObjectId("5a934e000102030405000000"),"field":2.334},{"_id":2,"field":2}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `update with arrayFilter`,
@@ -558,7 +565,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({grades:{$gte:100}},{$set:{"grades.$[element]":100}}, {"multi": true, arrayFilters: [{"element": { $gte: 100 }}]})`},
 			},
 			result:    `[{"_id":1,"grades":[95,92,90]},{"_id":2,"grades":[98,100,100]},{"_id":3,"grades":[95,100,100]}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `empty update`,
@@ -568,7 +575,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update()`},
 			},
 			result:    `fail to run update: update document must have at least one element`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `upsert with empty db`,
@@ -578,7 +585,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({},{"$set":{"_id":"new"}},{"upsert":true})`},
 			},
 			result:    `[{"_id":"new"}]`,
-			createdDB: 1, // this should create a db even if config is empty, because of the upsert
+			createdDB: 0, // updates run in an ephemeral database, dropped after the query
 		},
 		{
 			name: `update with pipeline`,
@@ -588,7 +595,7 @@ func TestRunCreateDB(t *testing.T) {
 				"query":  {`db.collection.update({},[{"$set": { "health": "$maxHealth" }}])`},
 			},
 			result:    `[{"_id":1,"health":200,"maxHealth":200,"username":"moshe"}]`,
-			createdDB: 1,
+			createdDB: 0,
 		},
 		{
 			name: `explain default`,
@@ -862,15 +869,15 @@ func TestRunUpdateTwice(t *testing.T) {
 	if want != got {
 		t.Errorf("expected %s but got %s", want, got)
 	}
-	// re-run the same run query, activeDatabase counter should not be
-	// incremented because it's the same db, even if we re-create it
-	// every time
+	// re-run the same run query, the result should be the same as
+	// the update runs in a brand new database every time
 	got = httpBody(t, runEndpoint, http.MethodPost, params)
 	if want != got {
 		t.Errorf("expected %s but got %s", want, got)
 	}
 
-	testStorageContent(t, 1, 0)
+	// ephemeral databases are not kept
+	testStorageContent(t, 0, 0)
 }
 
 func TestRunFindAfterUpdate(t *testing.T) {
@@ -883,7 +890,8 @@ func TestRunFindAfterUpdate(t *testing.T) {
 		t.Errorf("expected %s but got %s", want, got)
 	}
 	// change query to be a find(), but keep mode and config the same as for
-	// the previous update(). This should create a distinct db
+	// the previous update(). The update ran in an ephemeral db, so the find
+	// should not see its changes
 	params.Set("query", "db.collection.find()")
 	want = `[{"_id":1}]`
 	got = httpBody(t, runEndpoint, http.MethodPost, params)
@@ -891,7 +899,51 @@ func TestRunFindAfterUpdate(t *testing.T) {
 		t.Errorf("expected %s but got %s", want, got)
 	}
 
-	testStorageContent(t, 2, 0)
+	testStorageContent(t, 1, 0)
+}
+
+// before updates were run in ephemeral databases, concurrent runs of the same
+// update shared a database that was dropped and re-filled by each request. A
+// request could then read a database half-created by another one, or fail with
+// a duplicate key error while inserting documents
+func TestRunConcurrentUpdates(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	config := make([]string, 0, maxDoc)
+	for i := 0; i < maxDoc; i++ {
+		config = append(config, fmt.Sprintf(`{"_id":%d,"n":1}`, i))
+	}
+	params := url.Values{
+		"mode":   {"bson"},
+		"config": {"[" + strings.Join(config, ",") + "]"},
+		"query":  {`db.collection.update({},{"$inc":{"n":1}},{"multi":true})`},
+	}
+
+	t.Run("parallel update", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			t.Run(fmt.Sprintf("update %d", i), func(t *testing.T) {
+
+				t.Parallel()
+
+				got := httpBody(t, runEndpoint, http.MethodPost, params)
+				if want := `"n":2`; strings.Count(got, want) != maxDoc {
+					t.Errorf("expected %d docs with %s, but got\n '%s'", maxDoc, want, got)
+				}
+			})
+		}
+	})
+
+	testStorageContent(t, 0, 0)
+}
+
+func TestRunBodyTooBig(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	testBodyTooBig(t, runEndpoint)
+
+	testStorageContent(t, 0, 0)
 }
 
 func TestConsistentError(t *testing.T) {
@@ -911,3 +963,296 @@ func TestConsistentError(t *testing.T) {
 		t.Errorf("expected\n'%s'\n but got\n'%s'", want, got)
 	}
 }
+
+func TestRunOutputFormats(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	outputTests := []struct {
+		name        string
+		output      string
+		result      string
+		contentType string
+	}{
+		{
+			name:        "default output",
+			output:      "",
+			result:      `[{"_id":1,"a":{"b":"x"},"c":[1,2]}]`,
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:   "pretty",
+			output: prettyOutput,
+			result: `[
+  {
+    "_id": 1,
+    "a": {
+      "b": "x"
+    },
+    "c": [
+      1,
+      2
+    ]
+  }
+]`,
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "canonical extended json",
+			output:      canonicalOutput,
+			result:      `[{"_id":{"$numberDouble":"1.0"},"a":{"b":"x"},"c":[{"$numberDouble":"1.0"},{"$numberDouble":"2.0"}]}]`,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "relaxed extended json",
+			output:      relaxedOutput,
+			result:      `[{"_id":1.0,"a":{"b":"x"},"c":[1.0,2.0]}]`,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "csv",
+			output:      csvOutput,
+			result:      "_id,a.b,c.0,c.1\n1,x,1,2\n",
+			contentType: "text/csv; charset=utf-8",
+		},
+		{
+			name:        "invalid output",
+			output:      "xml",
+			result:      errInvalidOutput,
+			contentType: "text/plain; charset=utf-8",
+		},
+	}
+
+	for _, tt := range outputTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			params := url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":{"b":"x"},"c":[1,2]}]`},
+				"query":  {templateQuery},
+				"output": {test.output},
+			}
+			req, _ := http.NewRequest(http.MethodPost, runEndpoint, strings.NewReader(params.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			resp := httptest.NewRecorder()
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := test.result, resp.Body.String(); want != got {
+				t.Errorf("expected\n '%s'\n but got\n '%s'", want, got)
+			}
+			if want, got := test.contentType, resp.Header().Get("Content-Type"); want != got {
+				t.Errorf("expected Content-Type: %s, but got %s", want, got)
+			}
+		})
+	}
+
+	// bson output can be read back by the driver
+	b, err := (&runResult{docs: []bson.Raw{bson.Raw(mustMarshal(t, bson.M{"_id": 1}))}}).format(bsonOutput)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := bson.Raw(b).Validate(); err != nil {
+		t.Errorf("invalid bson output: %v", err)
+	}
+}
+
+func mustMarshal(t *testing.T, doc interface{}) []byte {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRunCursorPagination(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	// 100 docs with an array of 'arraySize' elements. Once unwound, each
+	// document is 12 bytes long, like {"a": 1}
+	configFormat := `[{"collection":"collection","count":100,"content":{"a":{"type":"array","minLength":%d,"maxLength":%d,"arrayContent":{"type":"int","minInt":0,"maxInt":10}}}}]`
+	query := `db.collection.aggregate([{"$unwind":"$a"},{"$project":{"_id":0}}])`
+
+	paginationTests := []struct {
+		name       string
+		arraySize  int
+		docCount   int
+		totalCount int
+		truncated  bool
+	}{
+		{
+			name:       "several batches",
+			arraySize:  15,
+			docCount:   1500,
+			totalCount: 1500,
+			truncated:  false,
+		},
+		{
+			// the batch reaching the size limit is the last one
+			// read, so only 9 batches out of 10 are counted
+			name:       "result bigger than size limit",
+			arraySize:  100,
+			docCount:   testResultSizeLimit / 12,
+			totalCount: 9 * getMoreBatchSize,
+			truncated:  true,
+		},
+	}
+
+	for _, tt := range paginationTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			params := url.Values{
+				"mode":   {"mgodatagen"},
+				"config": {fmt.Sprintf(configFormat, test.arraySize, test.arraySize)},
+				"query":  {query},
+			}
+			req, _ := http.NewRequest(http.MethodPost, runEndpoint, strings.NewReader(params.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			resp := httptest.NewRecorder()
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := fmt.Sprint(test.docCount), resp.Header().Get("X-Result-Count"); want != got {
+				t.Errorf("expected %s documents, but got %s", want, got)
+			}
+			if want, got := fmt.Sprint(test.totalCount), resp.Header().Get("X-Result-Total"); want != got {
+				t.Errorf("expected %s documents in total, but got %s", want, got)
+			}
+			if want, got := fmt.Sprint(test.truncated), resp.Header().Get("X-Result-Truncated"); want != got {
+				t.Errorf("expected truncated to be %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestRunConcurrentSameDatabase(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	t.Run("parallel run", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			t.Run(fmt.Sprintf("run %d", i), func(t *testing.T) {
+
+				t.Parallel()
+
+				// all requests wait for a single database creation
+				got := httpBody(t, runEndpoint, http.MethodPost, templateParams)
+				if want := templateResult; want != got {
+					t.Errorf("expected\n '%s'\n but got\n '%s'", want, got)
+				}
+			})
+		}
+	})
+
+	testStorageContent(t, 1, 0)
+}
+
+// run concurrently a mix of playgrounds sharing a few databases, and of
+// playgrounds needing a new database. Creating a new database should not
+// slow down playgrounds using an existing one
+func BenchmarkRunConcurrentMixedPlaygrounds(b *testing.B) {
+
+	defer clearDatabases(b)
+
+	var counter int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+
+			n := atomic.AddInt64(&counter, 1)
+
+			mode := bsonLabel
+			config := fmt.Sprintf(`[{"_id":1,"k":%d}]`, n%8)
+			if n%4 == 0 {
+				mode = mgodatagenLabel
+				config = fmt.Sprintf(`[{"collection":"collection","count":100,"content":{"k":{"type":"constant","constVal":%d},"s":{"type":"string","minLength":2,"maxLength":50}}}]`, n)
+			}
+
+			p, _ := newPage(mode, config, templateQuery)
+			if _, err := testStorage.run(context.Background(), p); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestRunResultCache(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	resultCacheTests := []struct {
+		name   string
+		query  string
+		cached bool
+	}{
+		{
+			name:   "find",
+			query:  `db.collection.find({"_id":1})`,
+			cached: true,
+		},
+		{
+			name:   "aggregate",
+			query:  `db.collection.aggregate([{"$match":{"_id":1}}])`,
+			cached: true,
+		},
+		{
+			name:   "explain",
+			query:  `db.collection.find().explain()`,
+			cached: true,
+		},
+		{
+			name:   "update",
+			query:  `db.collection.update({},{"$set":{"k":1}})`,
+			cached: false,
+		},
+		{
+			name:   "non deterministic aggregate",
+			query:  `db.collection.aggregate([{"$sample":{"size":1}}])`,
+			cached: false,
+		},
+	}
+
+	for _, tt := range resultCacheTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			p, _ := newPage(bsonLabel, `[{"_id":1},{"_id":2}]`, test.query)
+
+			first, err := testStorage.run(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.cached {
+				t.Errorf("first run should not come from cache")
+			}
+
+			hits := testutil.ToFloat64(resultCacheHits)
+			second, err := testStorage.run(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := test.cached, second.cached; want != got {
+				t.Errorf("expected cached to be %v but got %v", want, got)
+			}
+			if test.cached {
+				if want, got := hits+1, testutil.ToFloat64(resultCacheHits); want != got {
+					t.Errorf("expected %v cache hits but got %v", want, got)
+				}
+				if want, got := first.docCount, second.docCount; want != got {
+					t.Errorf("expected %d docs but got %d", want, got)
+				}
+			}
+		})
+	}
+
+	// a new version of MongoDB may produce a different result
+	p, _ := newPage(bsonLabel, `[{"_id":1},{"_id":2}]`, `db.collection.find({"_id":1})`)
+	if _, ok := testStorage.resultCache.get(resultCacheKey(p, []byte("0.0.0"))); ok {
+		t.Errorf("result should not be cached for another version of MongoDB")
+	}
+}
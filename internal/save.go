@@ -17,60 +17,124 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-
-	"github.com/dgraph-io/badger/v2"
 )
 
+// returned when all the alternate ids of a page are used by other pages
+var errTooManyCollisions = errors.New("too many id collisions")
+
 // save the playground and return the playground url, which looks
 // like:
 //
 //   https://mongoplayground.net/p/nJhd-dhf3Ea
+//
+// If the 'private' form field is 'true', the playground is saved as a
+// private playground, optionally protected by the 'password' form field,
+// and the url holds its read token.
+//
+// If the 'expiry' form field is '1d', '1w' or '1m', the playground
+// expires after a day, a week or a month
 func (s *storage) saveHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	p, err := newPage(
-		r.FormValue("mode"),
-		r.FormValue("config"),
-		r.FormValue("query"),
-	)
+	p, err := newPageFromForm(r)
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writePageError(w, err)
+		return
+	}
+	ttl, err := parseExpiry(r.FormValue("expiry"))
+	if err != nil {
+		writePageError(w, err)
+		return
+	}
+
+	if r.FormValue("private") == "true" {
+		id, token, err := s.savePrivate(p, r.FormValue("password"), ttl)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(errInternalServerError))
+			return
+		}
+		fmt.Fprintf(w, "%sp/%s?%s=%s", r.Referer(), id, tokenParam, token)
+		return
+	}
+
+	if ttl > 0 {
+		id, err := s.saveExpiring(p, ttl)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(errInternalServerError))
+			return
+		}
+		fmt.Fprintf(w, "%sp/%s", r.Referer(), id)
 		return
 	}
 
-	id := s.save(p)
+	id, newRecord, err := s.save(p)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(errInternalServerError))
+		return
+	}
+	if newRecord {
+		if err := s.recordParent(id, s.parentFromRequest(r, r.FormValue("parent"))); err != nil {
+			log.Printf("fail to record parent of playground %s: %v", id, err)
+		}
+	}
 
 	fmt.Fprintf(w, "%sp/%s", r.Referer(), id)
 }
 
-func (s *storage) save(p *page) []byte {
-
-	id, val := p.ID(), p.encode()
+// save the page if it's not already present, and return its id.
+// newRecord is true if the page wasn't saved before.
+//
+// If another page is already saved with the same id, the page is saved
+// with the next alternate id instead, see page.alternateID(). If the page
+// can't be saved, an error is returned and id is nil, so the id of
+// another page is never returned
+func (s *storage) save(p *page) (id []byte, newRecord bool, err error) {
 
-	// before saving, check if the playground is not already
-	// saved
-	alreadySaved := false
-	s.kvStore.View(func(txn *badger.Txn) error {
+	val, ref, configStorage, err := s.encodePage(p)
+	if err != nil {
+		return nil, false, fmt.Errorf("fail to save playground %s: %v", p.ID(), err)
+	}
 
-		_, err := txn.Get(id)
-		// if the key is not found, an 'ErrKeyNotFound' is returned.
-		// hence if the error is nil, the playground is already saved
-		if err == nil {
-			alreadySaved = true
+	for n := 0; n < maxAlternateIDs; n++ {
+		id = p.alternateID(n)
+		newRecord, err = s.store.putIfAbsent(id, val)
+		if err != nil || newRecord {
+			break
+		}
+		var saved *page
+		saved, err = s.loadPage(id)
+		if err != nil || saved.equal(p) {
+			break
 		}
-		return nil
-	})
+		log.Printf("id collision for playground %s", id)
+		savedPlaygroundIDCollisions.Inc()
+		err = errTooManyCollisions
+	}
 
-	if !alreadySaved {
-		s.kvStore.Update(func(txn *badger.Txn) error {
-			return txn.Set(id, val)
-		})
+	if !newRecord && ref != nil {
+		// the page already references the blob, or won't be saved
+		if releaseErr := s.releaseConfigBlob(ref); releaseErr != nil {
+			log.Printf("fail to save playground %s: %v", id, releaseErr)
+		}
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("fail to save playground %s: %v", p.ID(), err)
+	}
+	if newRecord {
 		// At this point, we know for sure that a new playground
 		// has been saved, so update the stats
-		savedPlaygroundSize.WithLabelValues(p.label()).Observe(float64(len(val)))
+		savedPlaygroundSize.WithLabelValues(p.label(), configStorage).Observe(float64(p.encodedSize()))
 	}
-	return id
+	return id, newRecord, nil
 }
@@ -17,7 +17,7 @@
 package internal
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -25,7 +25,8 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestSave(t *testing.T) {
@@ -133,27 +134,41 @@ func testPlaygroundStats(t *testing.T, nbMgoDatagen, nbBsonSingle, nbBsonMultipl
 
 	// reset saved playground metrics
 	savedPlaygroundSize.Reset()
-	computeSavedPlaygroundStats(testStorage.kvStore)
+	computeSavedPlaygroundStats(testStorage.store)
 
-	resp := httptest.NewRecorder()
-	req, _ := http.NewRequest(http.MethodGet, metricsEndpoint, nil)
-	promhttp.Handler().ServeHTTP(resp, req)
-
-	want := fmt.Sprintf(`saved_playground_size_count{type="bson_multiple_collection"} %d
-saved_playground_size_count{type="bson_single_collection"} %d
-saved_playground_size_count{type="mgodatagen"} %d
-saved_playground_size_count{type="unknown"} %d`, nbBsonMultiple, nbBsonSingle, nbMgoDatagen, nbUnknown)
-
-	lines := make([]string, 0, 4)
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		if strings.HasPrefix(scanner.Text(), "saved_playground_size_count") {
-			lines = append(lines, scanner.Text())
-		}
+	want := map[string]int{
+		`config="inline",type="bson_multiple_collection"`: nbBsonMultiple,
+		`config="inline",type="bson_single_collection"`:   nbBsonSingle,
+		`config="inline",type="mgodatagen"`:               nbMgoDatagen,
+		`config="inline",type="unknown"`:                  nbUnknown,
+	}
+	if got := savedPlaygroundCounts(t); fmt.Sprint(want) != fmt.Sprint(got) {
+		t.Errorf("expected %v\n but got\n %v", want, got)
+	}
+}
+
+// returns the number of saved playgrounds observed by saved_playground_size
+// for each set of labels, like `config="inline",type="mgodatagen"`
+func savedPlaygroundCounts(t *testing.T) map[string]int {
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(savedPlaygroundSize)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if got := strings.Join(lines, "\n"); want != got {
-		t.Errorf("expected %s\n but got\n %s", want, got)
+
+	counts := map[string]int{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0, 2)
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, label.GetName(), label.GetValue()))
+			}
+			counts[strings.Join(labels, ",")] = int(metric.GetHistogram().GetSampleCount())
+		}
 	}
+	return counts
 }
 
 func TestErrorOnSavePlaygroundTooBig(t *testing.T) {
@@ -171,3 +186,81 @@ func TestErrorOnSavePlaygroundTooBig(t *testing.T) {
 	}
 
 }
+
+func TestSaveBodyTooBig(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	testBodyTooBig(t, saveEndpoint)
+
+	testStorageContent(t, 0, 0)
+}
+
+func TestSaveIDCollision(t *testing.T) {
+
+	s := &storage{store: newMemoryStore()}
+
+	p, _ := newPage(bsonLabel, `[{"k": 1}]`, "db.collection.find()")
+	other, _ := newPage(bsonLabel, `[{"k": 2}]`, "db.collection.find()")
+	// force a collision by saving another page with the id of p
+	s.store.putIfAbsent(p.ID(), other.encode())
+
+	collisions := testutil.ToFloat64(savedPlaygroundIDCollisions)
+
+	id, newRecord, err := s.save(p)
+	if want, got := p.alternateID(1), id; err != nil || !newRecord || !bytes.Equal(want, got) {
+		t.Errorf("expected new record with id %s but got %s, %v", want, got, newRecord)
+	}
+	if want, got := collisions+1, testutil.ToFloat64(savedPlaygroundIDCollisions); want != got {
+		t.Errorf("expected %v collisions but got %v", want, got)
+	}
+
+	// saving the page again returns the same alternate id
+	id, newRecord, err = s.save(p)
+	if want, got := p.alternateID(1), id; err != nil || newRecord || !bytes.Equal(want, got) {
+		t.Errorf("expected existing record with id %s but got %s, %v", want, got, newRecord)
+	}
+
+	for _, tt := range []struct {
+		id   []byte
+		page *page
+	}{{p.ID(), other}, {p.alternateID(1), p}} {
+		saved, err := s.loadPage(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tt.page.equal(saved) {
+			t.Errorf("expected page %s with id %s but got %s", tt.page.encode(), tt.id, saved.encode())
+		}
+	}
+
+	// all alternate ids are used by other pages
+	for n := 0; n < maxAlternateIDs; n++ {
+		s.store.update(p.alternateID(n), func(old []byte) ([]byte, error) {
+			return other.encode(), nil
+		})
+	}
+	id, newRecord, err = s.save(p)
+	if err == nil || newRecord || id != nil {
+		t.Errorf("page should not be saved when all alternate ids are used, got %s, %v, %v", id, newRecord, err)
+	}
+
+	// the handlers don't return the url of another page
+	resp := httptest.NewRecorder()
+	s.apiSaveHandler(resp, httptest.NewRequest(http.MethodPost, apiSaveEndpoint, strings.NewReader(`{"Mode":"bson","Config":"[{\"k\": 1}]","Query":"db.collection.find()"}`)))
+	if want, got := http.StatusInternalServerError, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+	req := httptest.NewRequest(http.MethodPost, saveEndpoint, strings.NewReader(url.Values{"mode": {"bson"}, "config": {`[{"k": 1}]`}, "query": {"db.collection.find()"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp = httptest.NewRecorder()
+	s.saveHandler(resp, req)
+	if want, got := http.StatusInternalServerError, resp.Code; want != got {
+		t.Errorf("expected response code %d but got %d", want, got)
+	}
+	for n := 0; n < maxAlternateIDs; n++ {
+		if strings.Contains(resp.Body.String(), string(p.alternateID(n))) {
+			t.Errorf("the id of another page should not be returned, got %s", resp.Body)
+		}
+	}
+}
@@ -17,6 +17,7 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -35,28 +36,133 @@ const (
 	staticEndpoint  = "/static/"
 	metricsEndpoint = "/metrics"
 	healthEndpoint  = "/health"
+	apiRunEndpoint  = "/api/v1/run"
+	apiSaveEndpoint = "/api/v1/save"
+	apiSlugEndpoint = "/api/v1/slugs"
+	// prefix of the admin endpoints, see admin.go
+	apiAdminEndpoint = "/api/v1/admin/"
+	openAPIEndpoint  = "/api/openapi.json"
 
 	readTimeout  = 10 * time.Second
 	writeTimeout = 30 * time.Second
 	idleTimeout  = 3 * time.Minute
+	// max time spent closing the storage once the
+	// running requests are completed
+	storageCloseTimeout = 30 * time.Second
 
 	errInternalServerError = "Internal server error.\n  Please file an issue here:\n\n  https://github.com/feliixx/mongoplayground/issues"
 )
 
+// Options holds the optional settings of the playground. Zero
+// values are valid, and disable the corresponding feature
+type Options struct {
+	// origins allowed to send cross-origin requests, like
+	// https://docs.example.com. Use "*" to allow any origin
+	AllowedOrigins []string
+	// max size in bytes of the documents returned by a single query.
+	// Remaining documents are counted but not returned. Default to
+	// defaultResultSizeLimit
+	ResultSizeLimit int
+	// max size in bytes of the results of read-only queries kept in
+	// memory. Default to defaultResultCacheSize, a negative value
+	// disables the cache
+	ResultCacheSize int
+	// max number of queries running at the same time. Default to
+	// defaultMaxConcurrentRuns, a negative value removes the limit
+	MaxConcurrentRuns int
+	// max number of queries waiting for a free slot. Once the queue
+	// is full, queries are rejected. Default to defaultMaxQueuedRuns
+	MaxQueuedRuns int
+	// rate limit of a single client per endpoint, like "/save".
+	// Endpoints without a limit are not throttled
+	RateLimits map[string]RateLimit
+	// ip or CIDR of the reverse proxies allowed to set the
+	// X-Forwarded-For header
+	TrustedProxies []string
+	// ip or CIDR of the clients that are never throttled
+	RateLimitAllowList []string
+	// max number of playground databases kept in MongoDB. Least recently
+	// used databases are dropped when it's exceeded. 0 for no limit
+	MaxActiveDatabases int
+	// max total size in bytes of the playground databases, as reported
+	// by dbStats. Least recently used databases are dropped when it's
+	// exceeded. 0 for no limit
+	MaxActiveDatabasesSize int64
+	// where playgrounds are saved: 'badger' (default), 'mongodb' or
+	// 'memory'. With 'mongodb', servers don't need a local disk
+	Store string
+	// interval between two garbage collections of badger value log.
+	// Default to defaultValueLogGCInterval, a negative value disables it
+	ValueLogGCInterval time.Duration
+	// hex encoded key encrypting the badger store and its backups,
+	// 16, 24 or 32 bytes long. An existing plaintext store is encrypted
+	// on startup. If empty, the store is not encrypted
+	EncryptionKey string
+	// hex encoded key the badger store was encrypted with until now.
+	// Set it along with a new EncryptionKey to rotate the key
+	PreviousEncryptionKey string
+	// tokens allowed to reserve slugs for saved playgrounds, sent in an
+	// 'Authorization: Bearer <token>' header. If empty, slugs can't be
+	// reserved
+	SlugTokens []string
+	// tokens allowed to look up, tombstone and restore saved playgrounds,
+	// sent in an 'Authorization: Bearer <token>' header. If empty, the
+	// admin endpoints are disabled
+	AdminTokens []string
+	// drop the databases created for playgrounds when the server is
+	// shut down. Don't enable it if several servers share the same
+	// MongoDB instance
+	DropDatabasesOnShutdown bool
+}
+
+// Server is the http server of the playground. Unlike http.Server,
+// its Shutdown method also releases the badger and mongodb connections
+type Server struct {
+	*http.Server
+	storage       *storage
+	dropDatabases bool
+}
+
 // NewServer initialize a badger and a mongodb connection,
 // and return an http server
-func NewServer(mongoUri string, dropFirst bool, badgerDir, backupDir string, mailInfo *MailInfo) (*http.Server, error) {
+func NewServer(mongoUri string, dropFirst bool, badgerDir, backupDir string, mailInfo *MailInfo, opts *Options) (*Server, error) {
 
-	storage, err := newStorage(mongoUri, dropFirst, badgerDir, backupDir, mailInfo)
+	storage, err := newStorage(mongoUri, dropFirst, badgerDir, backupDir, mailInfo, opts)
 	if err != nil {
 		return nil, err
 	}
-	return newHttpServerWithStorage(storage)
+	s, err := newHttpServerWithStorage(storage, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Server:        s,
+		storage:       storage,
+		dropDatabases: opts.DropDatabasesOnShutdown,
+	}, nil
+}
+
+// Shutdown stops accepting new requests and waits for the running ones
+// to complete, or for ctx to be done. The cleanup and backup jobs are
+// then stopped, and badger and mongodb connections closed, within
+// storageCloseTimeout.
+//
+// If the running requests don't complete before ctx is done, they may
+// still use badger and mongodb, so the connections are left open
+func (s *Server) Shutdown(ctx context.Context) error {
+
+	if err := s.Server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("running requests did not complete, storage left open: %v", err)
+	}
+
+	closeCtx, cancel := context.WithTimeout(context.Background(), storageCloseTimeout)
+	defer cancel()
+	return s.storage.close(closeCtx, s.dropDatabases)
 }
 
-func newHttpServerWithStorage(storage *storage) (*http.Server, error) {
+func newHttpServerWithStorage(storage *storage, opts *Options) (*http.Server, error) {
 
-	staticContent, err := compressStaticResources(storage.mongoVersion)
+	staticContent, err := compressStaticResources(storage.mongoVersion())
 	if err != nil {
 		return nil, fmt.Errorf("fail to compress static resources: %v", err)
 	}
@@ -69,11 +175,23 @@ func newHttpServerWithStorage(storage *storage) (*http.Server, error) {
 	mux.HandleFunc(saveEndpoint, storage.saveHandler)
 	mux.HandleFunc(staticEndpoint, staticContent.staticHandler)
 	mux.HandleFunc(healthEndpoint, storage.healthHandler)
+	mux.HandleFunc(apiRunEndpoint, storage.apiRunHandler)
+	mux.HandleFunc(apiSaveEndpoint, storage.apiSaveHandler)
+	mux.HandleFunc(apiSlugEndpoint, storage.apiSlugHandler)
+	if len(opts.AdminTokens) > 0 {
+		mux.HandleFunc(apiAdminEndpoint, storage.apiAdminHandler)
+	}
+	mux.HandleFunc(openAPIEndpoint, staticContent.openAPIHandler)
 	mux.Handle(metricsEndpoint, promhttp.Handler())
 
+	limiter, err := newRateLimiter(opts.RateLimits, opts.TrustedProxies, opts.RateLimitAllowList)
+	if err != nil {
+		return nil, err
+	}
+
 	return &http.Server{
 		Addr:         ":8080",
-		Handler:      latencyAndPanicObserver(mux, storage.mailInfo),
+		Handler:      latencyAndPanicObserver(cors(rateLimit(mux, limiter), opts.AllowedOrigins), storage.mailInfo),
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
 		IdleTimeout:  idleTimeout,
@@ -106,6 +224,8 @@ func latencyAndPanicObserver(handler http.Handler, mailInfo *MailInfo) http.Hand
 			label = staticEndpoint
 		} else if strings.HasPrefix(label, viewEndpoint) {
 			label = viewEndpoint
+		} else if strings.HasPrefix(label, apiAdminEndpoint) {
+			label = apiAdminEndpoint
 		}
 
 		if label != viewEndpoint &&
@@ -113,13 +233,63 @@ func latencyAndPanicObserver(handler http.Handler, mailInfo *MailInfo) http.Hand
 			label != saveEndpoint &&
 			label != staticEndpoint &&
 			label != healthEndpoint &&
-			label != metricsEndpoint {
+			label != metricsEndpoint &&
+			label != apiRunEndpoint &&
+			label != apiSaveEndpoint &&
+			label != apiSlugEndpoint &&
+			label != apiAdminEndpoint &&
+			label != openAPIEndpoint {
 			label = "invalid"
 		}
 		requestDurations.WithLabelValues(label).Observe(float64(time.Since(start)) / float64(time.Second))
 	})
 }
 
+// Middleware handler allowing browsers to call the playground from
+// the configured origins. Preflight requests are answered directly.
+// If any origin is allowed with "*", the response is the same for all
+// origins, and Access-Control-Allow-Origin is "*"
+func cors(handler http.Handler, allowedOrigins []string) http.Handler {
+
+	if len(allowedOrigins) == 0 {
+		return handler
+	}
+
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if !allowed[origin] {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func handleAnyPanic(w http.ResponseWriter, r *http.Request, mailInfo *MailInfo) {
 
 	if panic := recover(); panic != nil {
@@ -36,6 +36,7 @@ import (
 const (
 	templateResult    = `[{"_id":ObjectId("5a934e000102030405000000"),"k":10},{"_id":ObjectId("5a934e000102030405000001"),"k":2},{"_id":ObjectId("5a934e000102030405000002"),"k":7},{"_id":ObjectId("5a934e000102030405000003"),"k":6},{"_id":ObjectId("5a934e000102030405000004"),"k":9},{"_id":ObjectId("5a934e000102030405000005"),"k":10},{"_id":ObjectId("5a934e000102030405000006"),"k":9},{"_id":ObjectId("5a934e000102030405000007"),"k":10},{"_id":ObjectId("5a934e000102030405000008"),"k":2},{"_id":ObjectId("5a934e000102030405000009"),"k":1}]`
 	templateURL       = "p/snbIQ3uGHGq"
+	testOrigin        = "https://docs.example.com"
 	templateConfigOld = `[
   {
     "collection": "collection",
@@ -51,6 +52,10 @@ const (
 ]`
 )
 
+// small enough to be reached by a query returning a few
+// thousand documents
+const testResultSizeLimit = 100 * 1000
+
 var (
 	templateParams = url.Values{"mode": {"mgodatagen"}, "config": {templateConfigOld}, "query": {templateQuery}}
 	testServer     *http.Server
@@ -64,24 +69,30 @@ func TestMain(m *testing.M) {
 	storageDir, _ := ioutil.TempDir(os.TempDir(), "storage")
 	backupsDir, _ := ioutil.TempDir(os.TempDir(), "backups")
 
-	ts, err := newStorage("mongodb://localhost:27017", true, storageDir, backupsDir, nil)
+	opts := &Options{
+		AllowedOrigins:  []string{testOrigin},
+		ResultSizeLimit: testResultSizeLimit,
+	}
+
+	ts, err := newStorage("mongodb://localhost:27017", true, storageDir, backupsDir, nil, opts)
 	if err != nil {
 		fmt.Printf("aborting: %v\n", err)
 		os.Exit(1)
 	}
 	testStorage = ts
 
-	s, err := newHttpServerWithStorage(testStorage)
+	s, err := newHttpServerWithStorage(testStorage, opts)
 	if err != nil {
 		fmt.Printf("aborting: %v\n", err)
 		os.Exit(1)
 	}
 	testServer = s
 
-	defer testStorage.mongoSession.Disconnect(context.Background())
-	defer testStorage.kvStore.Close()
-
 	retCode := m.Run()
+
+	if err := testStorage.close(context.Background(), false); err != nil {
+		fmt.Printf("fail to close storage: %v\n", err)
+	}
 	os.Exit(retCode)
 }
 
@@ -95,6 +106,90 @@ func TestBasePage(t *testing.T) {
 	checkServerResponse(t, "/robots.txt", http.StatusNotFound, "", gzipEncoding)
 }
 
+func TestCORS(t *testing.T) {
+
+	t.Parallel()
+
+	corsTests := []struct {
+		name         string
+		method       string
+		origin       string
+		allowOrigin  string
+		responseCode int
+	}{
+		{
+			name:         "allowed origin",
+			method:       http.MethodGet,
+			origin:       testOrigin,
+			allowOrigin:  testOrigin,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "preflight from allowed origin",
+			method:       http.MethodOptions,
+			origin:       testOrigin,
+			allowOrigin:  testOrigin,
+			responseCode: http.StatusNoContent,
+		},
+		{
+			name:         "unknown origin",
+			method:       http.MethodGet,
+			origin:       "https://evil.example.com",
+			allowOrigin:  "",
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "same origin",
+			method:       http.MethodGet,
+			origin:       "",
+			allowOrigin:  "",
+			responseCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range corsTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(test.method, healthEndpoint, nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := test.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d", want, got)
+			}
+			if want, got := test.allowOrigin, resp.Header().Get("Access-Control-Allow-Origin"); want != got {
+				t.Errorf("expected Access-Control-Allow-Origin: '%s', but got '%s'", want, got)
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+
+	t.Parallel()
+
+	handler := cors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{"*"})
+
+	for _, method := range []string{http.MethodGet, http.MethodOptions} {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, healthEndpoint, nil)
+		req.Header.Set("Origin", testOrigin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		handler.ServeHTTP(resp, req)
+
+		if want, got := "*", resp.Header().Get("Access-Control-Allow-Origin"); want != got {
+			t.Errorf("expected Access-Control-Allow-Origin: '%s', but got '%s'", want, got)
+		}
+	}
+}
+
 func checkServerResponse(t *testing.T, url string, expectedResponseCode int, expectedContentType, expectedEncoding string) {
 
 	resp := httptest.NewRecorder()
@@ -150,3 +245,83 @@ func httpBody(t *testing.T, url string, method string, params url.Values) string
 	testServer.Handler.ServeHTTP(resp, req)
 	return resp.Body.String()
 }
+
+// check that a playground too big is rejected with a 413, whether
+// the size of the body is known before reading it or not
+func testBodyTooBig(t *testing.T, endpoint string) {
+
+	bigConfig := url.Values{
+		"mode":   {"bson"},
+		"config": {strings.Repeat("a", maxByteSize)},
+		"query":  {"db.collection.find()"},
+	}.Encode()
+	// each byte is encoded as '%00', so the body is bigger than
+	// maxBodySize even if the decoded config is smaller than maxByteSize
+	bigBody := url.Values{
+		"mode":   {"bson"},
+		"config": {string(make([]byte, maxBodySize/3+1))},
+		"query":  {"db.collection.find()"},
+	}.Encode()
+
+	bodyTooBigTests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		// max number of bytes read from the body before rejecting it
+		maxRead int
+	}{
+		{
+			name:          "config too big",
+			body:          bigConfig,
+			contentLength: int64(len(bigConfig)),
+			maxRead:       len(bigConfig),
+		},
+		{
+			name:          "body too big",
+			body:          bigBody,
+			contentLength: int64(len(bigBody)),
+			maxRead:       0,
+		},
+		{
+			name:          "body too big with unknown length",
+			body:          bigBody,
+			contentLength: -1,
+			maxRead:       maxBodySize + 1,
+		},
+	}
+
+	for _, tt := range bodyTooBigTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			body := &countingReader{r: strings.NewReader(test.body)}
+			req := httptest.NewRequest(http.MethodPost, endpoint, body)
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.ContentLength = test.contentLength
+			resp := httptest.NewRecorder()
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := http.StatusRequestEntityTooLarge, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d", want, got)
+			}
+			if want, got := errPlaygroundToBig, resp.Body.String(); want != got {
+				t.Errorf("expected %s but got %s", want, got)
+			}
+			if body.n > test.maxRead {
+				t.Errorf("expected at most %d bytes to be read but got %d", test.maxRead, body.n)
+			}
+		})
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
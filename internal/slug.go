@@ -0,0 +1,185 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A slug is a readable alias of a saved playground, like 'lookup-unwind-demo',
+// so it can be viewed at /p/lookup-unwind-demo. Slugs are reserved with
+// /api/v1/slugs by clients having one of the configured tokens, and are
+// saved in the playground store along with the pages
+const (
+	// prefix of the keys of the slugs in the playground store
+	slugPrefix    = "slug/"
+	minSlugLength = 3
+	maxSlugLength = 64
+)
+
+// lowercase words separated by a single '-'. As slugs can't contain '.'
+// or '/', they can be followed by an export suffix like ids
+var slugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// body of a request to /api/v1/slugs
+type apiSlugRequest struct {
+	Slug string
+	// id of the saved playground to alias
+	ID string
+}
+
+type apiSlugResponse struct {
+	Slug string
+	ID   string
+	URL  string
+}
+
+// returns the key of the slug in the playground store
+func slugKey(slug []byte) []byte {
+	return append([]byte(slugPrefix), slug...)
+}
+
+// returns true if the slug has a valid charset and length. Slugs of
+// pageIDLength chars are rejected, as they could be the id of a page
+func isValidSlug(slug string) bool {
+	return len(slug) >= minSlugLength &&
+		len(slug) <= maxSlugLength &&
+		len(slug) != pageIDLength &&
+		slugRegexp.MatchString(slug)
+}
+
+// reserve a slug for a saved playground and return the url of the
+// playground as json. Status code is 201 if the slug is new, 200 if it
+// was already reserved for this playground, and 409 if it's used by
+// another playground. Requests must have an 'Authorization: Bearer <token>'
+// header with one of the configured tokens
+func (s *storage) apiSlugHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !allowOnlyPost(w, r) {
+		return
+	}
+	if !hasBearerToken(r, s.slugTokens) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, &playgroundError{kind: authError, msg: "a valid token is required to reserve a slug"})
+		return
+	}
+
+	if err := limitBody(r); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var req apiSlugRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, newPlaygroundError(requestError, "invalid request body: %v", err))
+		return
+	}
+
+	inserted, err := s.reserveSlug([]byte(req.Slug), []byte(req.ID))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if inserted {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, apiSlugResponse{
+		Slug: req.Slug,
+		ID:   req.ID,
+		URL:  playgroundURL(r, []byte(req.Slug)),
+	})
+}
+
+// save the slug as an alias of the page with this id. inserted is false
+// if the slug was already an alias of this page
+func (s *storage) reserveSlug(slug, id []byte) (inserted bool, err error) {
+
+	if !isValidSlug(string(slug)) {
+		return false, newPlaygroundError(requestError, "invalid slug '%s', expecting %d to %d lowercase letters, digits or '-', but not %d", slug, minSlugLength, maxSlugLength, pageIDLength)
+	}
+	if _, err := s.loadPage(id); err != nil {
+		return false, newPlaygroundError(notFoundError, "no playground with id '%s'", id)
+	}
+	// a slug would make a private playground easy to guess
+	if s.isPrivate(id) {
+		return false, newPlaygroundError(requestError, "slugs can't be reserved for private playgrounds")
+	}
+	if s.tombstone(id) != nil {
+		return false, newPlaygroundError(notFoundError, "no playground with id '%s'", id)
+	}
+	if !s.expiresAt(id).IsZero() {
+		return false, newPlaygroundError(requestError, "slugs can't be reserved for expiring playgrounds")
+	}
+
+	inserted, err = s.store.putIfAbsent(slugKey(slug), id)
+	if err != nil {
+		log.Printf("fail to save slug %s: %v", slug, err)
+		return false, err
+	}
+	if inserted {
+		return true, nil
+	}
+
+	aliased, err := s.resolveSlug(slug)
+	if err != nil {
+		return false, err
+	}
+	if string(aliased) != string(id) {
+		return false, newPlaygroundError(conflictError, "slug '%s' is already used by another playground", slug)
+	}
+	return false, nil
+}
+
+// return the id of the page aliased by the slug
+func (s *storage) resolveSlug(slug []byte) ([]byte, error) {
+	id, err := s.store.get(slugKey(slug))
+	if err != nil {
+		return nil, fmt.Errorf("fail to resolve slug %s: %v", slug, err)
+	}
+	return id, nil
+}
+
+// returns true if the request has an 'Authorization: Bearer <token>'
+// header with one of the tokens
+func hasBearerToken(r *http.Request, tokens []string) bool {
+	_, ok := bearerToken(r, tokens)
+	return ok
+}
+
+// returns the bearer token of the request, if it's one of tokens
+func bearerToken(r *http.Request, tokens []string) (string, bool) {
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return token, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSlugToken = "slug-token"
+
+func TestIsValidSlug(t *testing.T) {
+
+	t.Parallel()
+
+	slugTests := []struct {
+		slug  string
+		valid bool
+	}{
+		{slug: "lookup-unwind-demo", valid: true},
+		{slug: "demo2", valid: true},
+		{slug: "ab", valid: false},
+		{slug: strings.Repeat("a", maxSlugLength+1), valid: false},
+		// could be the id of a page
+		{slug: "lookup-demo", valid: false},
+		{slug: "Lookup-Demo", valid: false},
+		{slug: "lookup--demo", valid: false},
+		{slug: "-lookup", valid: false},
+		{slug: "lookup.json", valid: false},
+		{slug: "lookup/config", valid: false},
+	}
+
+	for _, tt := range slugTests {
+		if want, got := tt.valid, isValidSlug(tt.slug); want != got {
+			t.Errorf("%s: expected valid to be %v but got %v", tt.slug, want, got)
+		}
+	}
+}
+
+func TestAPISlug(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	testStorage.slugTokens = []string{testSlugToken}
+	defer func() { testStorage.slugTokens = nil }()
+
+	id, _, _ := testStorage.save(&page{Mode: mgodatagenMode, Config: []byte(templateConfigOld), Query: []byte(templateQuery)})
+	other, _, _ := testStorage.save(&page{Mode: bsonMode, Config: []byte(`[{"_id": 1}]`), Query: []byte(templateQuery)})
+
+	slugTests := []struct {
+		name         string
+		body         string
+		token        string
+		responseCode int
+	}{
+		{
+			name:         "new slug",
+			body:         `{"Slug":"lookup-unwind-demo","ID":"` + string(id) + `"}`,
+			token:        testSlugToken,
+			responseCode: http.StatusCreated,
+		},
+		{
+			name:         "same slug for same playground",
+			body:         `{"Slug":"lookup-unwind-demo","ID":"` + string(id) + `"}`,
+			token:        testSlugToken,
+			responseCode: http.StatusOK,
+		},
+		{
+			name:         "same slug for another playground",
+			body:         `{"Slug":"lookup-unwind-demo","ID":"` + string(other) + `"}`,
+			token:        testSlugToken,
+			responseCode: http.StatusConflict,
+		},
+		{
+			name:         "missing token",
+			body:         `{"Slug":"other-demo","ID":"` + string(id) + `"}`,
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "invalid token",
+			body:         `{"Slug":"other-demo","ID":"` + string(id) + `"}`,
+			token:        "invalid",
+			responseCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "invalid slug",
+			body:         `{"Slug":"Other Demo","ID":"` + string(id) + `"}`,
+			token:        testSlugToken,
+			responseCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unknown playground",
+			body:         `{"Slug":"other-demo","ID":"unknownURL0"}`,
+			token:        testSlugToken,
+			responseCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range slugTests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodPost, apiSlugEndpoint, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp := httptest.NewRecorder()
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := tt.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d: %s", want, got, resp.Body)
+			}
+		})
+	}
+
+	// the playground can be viewed and exported with its slug
+	checkServerResponse(t, viewEndpoint+"lookup-unwind-demo", http.StatusOK, "text/html; charset=utf-8", gzipEncoding)
+
+	req := httptest.NewRequest(http.MethodGet, viewEndpoint+"lookup-unwind-demo.json", nil)
+	resp := httptest.NewRecorder()
+	testServer.Handler.ServeHTTP(resp, req)
+
+	var exported exportedPage
+	json.Unmarshal(resp.Body.Bytes(), &exported)
+	if want, got := string(id), exported.Metadata.ID; want != got {
+		t.Errorf("expected id %s but got %s", want, got)
+	}
+
+	checkServerResponse(t, viewEndpoint+"unknown-slug", http.StatusNotFound, "text/plain; charset=utf-8", "")
+
+	// slugs are not counted as saved playgrounds
+	testStorageContent(t, 0, 2)
+}
@@ -82,6 +82,22 @@ func (s *staticContent) staticHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(resource.content)
 }
 
+// serve the OpenAPI specification of the playground
+func (s *staticContent) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	acceptedEncoding := gzipEncoding
+	if strings.Contains(r.Header.Get("Accept-Encoding"), brotliEncoding) {
+		acceptedEncoding = brotliEncoding
+	}
+
+	resource, _ := s.getResource("openapi.json", acceptedEncoding)
+
+	w.Header().Set("Content-Type", resource.contentType)
+	w.Header().Set("Content-Encoding", resource.contentEncoding)
+	w.Header().Set("Content-Length", strconv.Itoa(len(resource.content)))
+	w.Write(resource.content)
+}
+
 type staticResource struct {
 	content         []byte
 	contentType     string
@@ -159,6 +175,8 @@ func compressStaticResources(mongodbVersion []byte) (*staticContent, error) {
 	staticContent.addResourceFromFile("docs.html", "text/html; charset=utf-8", brotliEncoding)
 	staticContent.addResourceFromFile("about.html", "text/html; charset=utf-8", gzipEncoding)
 	staticContent.addResourceFromFile("about.html", "text/html; charset=utf-8", brotliEncoding)
+	staticContent.addResourceFromFile("openapi.json", "application/json; charset=utf-8", gzipEncoding)
+	staticContent.addResourceFromFile("openapi.json", "application/json; charset=utf-8", brotliEncoding)
 
 	return staticContent, nil
 }
@@ -17,7 +17,8 @@
 package internal
 
 import (
-	"github.com/dgraph-io/badger/v2"
+	"bytes"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -30,19 +31,109 @@ var (
 		},
 		[]string{"handler"},
 	)
+	resultCacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "result_cache_hits_total",
+			Help: "Queries whose result was found in the result cache",
+		},
+	)
+	resultCacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "result_cache_misses_total",
+			Help: "Read-only queries whose result was not in the result cache",
+		},
+	)
+	resultCacheSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "result_cache_size_bytes",
+			Help: "Size of the results kept in the result cache in bytes",
+		},
+	)
+	runQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "run_queue_depth",
+			Help: "Queries waiting for a free execution slot",
+		},
+	)
+	runQueueWaitDurations = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "run_queue_wait_seconds",
+			Help:    "Histogram of time spent by queries waiting for a free execution slot",
+			Buckets: []float64{0.001, 0.01, 0.1, 0.25, 0.5, 1, 2.5, 10},
+		},
+	)
+	rejectedRunsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "run_rejected_total",
+			Help: "Queries rejected because the execution queue was full",
+		},
+	)
+	rateLimitedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Requests rejected because the client exceeded the rate limit",
+		},
+		[]string{"handler"},
+	)
 	activeDatabasesCounter = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "active_db_count",
 			Help: "Active databases created on the Server",
 		},
 	)
+	activeDatabasesSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "active_db_size_bytes",
+			Help: "Size of the active databases, as reported by dbStats",
+		},
+	)
+	evictedDatabasesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "evicted_db_total",
+			Help: "Databases dropped because there were too many active databases, or because they were too big",
+		},
+		[]string{"reason"},
+	)
+	ephemeralDatabasesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ephemeral_db_total",
+			Help: "Databases created for a single request, like for update queries, by status: 'created', 'failed' if the creation failed, or 'drop_failed' if the database couldn't be dropped",
+		},
+		[]string{"status"},
+	)
 	savedPlaygroundSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "saved_playground_size",
-			Help:    "Histogram of saved playground size in byte",
+			Help:    "Histogram of saved playground size in byte, by type and by where their configuration is saved: 'inline', 'blob', or 'deduplicated' if it was already saved in a blob",
 			Buckets: []float64{1000, 5000, 10000, 100000, 300000},
 		},
-		[]string{"type"},
+		[]string{"type", "config"},
+	)
+	savedPlaygroundIDCollisions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "saved_playground_id_collisions_total",
+			Help: "Playgrounds saved with an alternate id because another playground had the same id",
+		},
+	)
+	adminActions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "admin_actions_total",
+			Help: "Saved playgrounds looked up, tombstoned or restored by an admin",
+		},
+		[]string{"action"},
+	)
+	adminUnauthorizedRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "admin_unauthorized_requests_total",
+			Help: "Requests to the admin endpoints rejected because they had no valid admin token",
+		},
+	)
+	storedValueCompressionRatio = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "saved_playground_compression_ratio",
+			Help:    "Histogram of the ratio between the size of saved values and their compressed size",
+			Buckets: []float64{1.25, 1.5, 2, 3, 5, 10, 20},
+		},
 	)
 	cleanupDuration = prometheus.NewGauge(
 		prometheus.GaugeOpts{
@@ -50,6 +141,30 @@ var (
 			Help: "Database cleanup in second",
 		},
 	)
+	badgerLSMSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "badger_lsm_size_bytes",
+			Help: "Size of badger LSM tree in bytes",
+		},
+	)
+	badgerValueLogSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "badger_vlog_size_bytes",
+			Help: "Size of badger value log in bytes",
+		},
+	)
+	badgerGCRewrittenFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "badger_vlog_gc_rewritten_files",
+			Help: "Value log files rewritten by the last garbage collection",
+		},
+	)
+	badgerGCLastRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "badger_vlog_gc_last_run_timestamp_seconds",
+			Help: "Unix time of the last value log garbage collection",
+		},
+	)
 	badgerBackupSize = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "badger_backup_size_bytes",
@@ -58,32 +173,115 @@ var (
 	)
 )
 
-func initPrometheusCounter(storage *badger.DB) {
+func initPrometheusCounter(store playgroundStore) {
 	prometheus.MustRegister(requestDurations)
+	prometheus.MustRegister(resultCacheHits)
+	prometheus.MustRegister(resultCacheMisses)
+	prometheus.MustRegister(resultCacheSize)
+	prometheus.MustRegister(runQueueDepth)
+	prometheus.MustRegister(runQueueWaitDurations)
+	prometheus.MustRegister(rejectedRunsCounter)
+	prometheus.MustRegister(rateLimitedCounter)
 	prometheus.MustRegister(activeDatabasesCounter)
+	prometheus.MustRegister(activeDatabasesSize)
+	prometheus.MustRegister(evictedDatabasesCounter)
+	prometheus.MustRegister(ephemeralDatabasesCounter)
 	prometheus.MustRegister(savedPlaygroundSize)
+	prometheus.MustRegister(storedValueCompressionRatio)
+	prometheus.MustRegister(savedPlaygroundIDCollisions)
+	prometheus.MustRegister(adminActions)
+	prometheus.MustRegister(adminUnauthorizedRequests)
 	prometheus.MustRegister(cleanupDuration)
 	prometheus.MustRegister(badgerBackupSize)
+	prometheus.MustRegister(badgerLSMSize)
+	prometheus.MustRegister(badgerValueLogSize)
+	prometheus.MustRegister(badgerGCRewrittenFiles)
+	prometheus.MustRegister(badgerGCLastRun)
 
-	computeSavedPlaygroundStats(storage)
+	computeSavedPlaygroundStats(store)
 }
 
-func computeSavedPlaygroundStats(storage *badger.DB) {
-
-	storage.View(func(txn *badger.Txn) error {
+func computeSavedPlaygroundStats(store playgroundStore) {
 
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
+	// like when they're saved, private and expiring pages are not counted.
+	// The configuration of a page may be in a blob not iterated yet, and
+	// private or expiring pages may not be known yet, so pages are counted
+	// once all keys have been iterated
+	type blobInfo struct {
+		size int
+		// the label of a page only depends on the first
+		// bytes of its configuration
+		configPrefix []byte
+	}
+	type pageInfo struct {
+		id   string
+		mode byte
+		// size of the encoded page, without the
+		// configuration if it's in a blob
+		size int
+		// label of the page, or the key of its configuration blob
+		label   string
+		blobKey string
+	}
+	blobs := map[string]blobInfo{}
+	private := map[string]bool{}
+	expiring := map[string]bool{}
+	pages := make([]pageInfo, 0)
 
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			item.Value(func(val []byte) error {
-				p := &page{}
-				p.decode(val)
-				savedPlaygroundSize.WithLabelValues(p.label()).Observe(float64(len(val)))
-				return nil
-			})
+	store.iterate(func(id, val []byte) error {
+		if isConfigBlobKey(id) {
+			_, config := decodeConfigBlob(val)
+			blobs[string(id)] = blobInfo{
+				size:         len(config),
+				configPrefix: append([]byte(nil), config[:4]...),
+			}
+			return nil
+		}
+		if bytes.HasPrefix(id, []byte(accessPrefix)) {
+			private[string(id[len(accessPrefix):])] = true
+			return nil
 		}
+		if bytes.HasPrefix(id, []byte(expiryPrefix)) {
+			expiring[string(id[len(expiryPrefix):])] = true
+			return nil
+		}
+		if !isPageKey(id) {
+			return nil
+		}
+		p := &page{}
+		p.decode(val)
+		info := pageInfo{id: string(id), mode: p.Mode, size: len(val)}
+		if ref := configRef(val); ref != nil {
+			info.size = 5 + len(p.Query)
+			info.blobKey = string(configBlobKey(ref))
+		} else {
+			info.label = p.label()
+		}
+		pages = append(pages, info)
 		return nil
 	})
+
+	// the first page found with a blob is counted as the one
+	// that saved it, the others as deduplicated
+	counted := map[string]bool{}
+	for _, info := range pages {
+		if private[info.id] || expiring[info.id] {
+			continue
+		}
+		configStorage := inlineConfig
+		if info.blobKey != "" {
+			blob, ok := blobs[info.blobKey]
+			if !ok {
+				continue
+			}
+			info.label = (&page{Mode: info.mode, Config: blob.configPrefix}).label()
+			info.size += blob.size
+			configStorage = blobConfig
+			if counted[info.blobKey] {
+				configStorage = deduplicatedConfig
+			}
+			counted[info.blobKey] = true
+		}
+		savedPlaygroundSize.WithLabelValues(info.label, configStorage).Observe(float64(info.size))
+	}
 }
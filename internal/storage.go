@@ -17,15 +17,16 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/badger/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -40,68 +41,217 @@ const (
 
 type storage struct {
 	mongoSession *mongo.Client
-	mongoVersion []byte
-
-	kvStore *badger.DB
-	// local dir to store badger backups
+	// version of mongod as a []byte, updated by backup()
+	// while requests are served, see mongoVersion()
+	version atomic.Value
+
+	// saved playgrounds, and the name of the store type
+	store     playgroundStore
+	storeName string
+	// local dir to store backups of the saved playgrounds
 	backupDir           string
 	backupServiceStatus serviceInfo
 
 	// activeDB holds info of the database created / used during
-	// the last cleanupInterval. Its access is garded by activeDbLock
+	// the last cleanupInterval. dbCreations holds the databases
+	// currently being created, and dbDrops the evicted databases
+	// currently being dropped. dbUsers holds the number of requests
+	// currently querying each database. orphanDB holds the databases
+	// found without info on startup, with the date they were found.
+	// Their access is garded by activeDbLock
 	activeDbLock sync.RWMutex
 	activeDB     map[string]dbMetaInfo
+	dbCreations  map[string]*dbCreation
+	dbDrops      map[string]chan struct{}
+	dbUsers      map[string]int
+	orphanDB     map[string]int64
+	// caps on the number of databases in activeDB and on their total
+	// size in bytes. Least recently used databases are evicted first
+	maxActiveDB     int
+	maxActiveDBSize int64
+
+	// max size in bytes of the documents returned by a query
+	resultSizeLimit int
+	// results of the last read-only queries
+	resultCache *resultCache
+	// bounds the number of queries running at the same time
+	runLimiter *runLimiter
+
+	// tokens allowed to reserve slugs
+	slugTokens []string
+	// tokens allowed to use the admin endpoints
+	adminTokens []string
 
 	mailInfo *MailInfo
+
+	// stopJobs stops the cleanup and backup loops. jobs
+	// is used to wait for a running job to complete
+	stopJobs context.CancelFunc
+	jobs     sync.WaitGroup
 }
 
-func newStorage(mongoUri string, dropFirst bool, badgerDir, backupDir string, mailInfo *MailInfo) (*storage, error) {
+func newStorage(mongoUri string, dropFirst bool, badgerDir, backupDir string, mailInfo *MailInfo, opts *Options) (*storage, error) {
 
 	session, err := createMongodbSession(mongoUri)
 	if err != nil {
 		return nil, err
 	}
 
-	kvStore, err := badger.Open(badger.DefaultOptions(badgerDir))
+	store, err := newPlaygroundStore(opts, badgerDir, session)
 	if err != nil {
 		return nil, err
 	}
+	compressed := &compressedStore{store}
+	storeName := opts.Store
+	if storeName == "" {
+		storeName = badgerStoreName
+	}
 
 	s := &storage{
 		mongoSession: session,
-		mongoVersion: getMongodVersion(session),
-		kvStore:      kvStore,
+		store:        compressed,
+		storeName:    storeName,
 		activeDB:     map[string]dbMetaInfo{},
+		dbCreations:  map[string]*dbCreation{},
+		dbDrops:      map[string]chan struct{}{},
+		dbUsers:      map[string]int{},
+		orphanDB:     map[string]int64{},
 		backupDir:    backupDir,
 		backupServiceStatus: serviceInfo{
 			Name:   "backup",
 			Status: statusUp,
 		},
-		mailInfo: mailInfo,
+		resultSizeLimit: opts.ResultSizeLimit,
+		resultCache:     newResultCache(opts.ResultCacheSize),
+		runLimiter:      newRunLimiter(opts.MaxConcurrentRuns, opts.MaxQueuedRuns),
+		maxActiveDB:     opts.MaxActiveDatabases,
+		maxActiveDBSize: opts.MaxActiveDatabasesSize,
+		slugTokens:      opts.SlugTokens,
+		adminTokens:     opts.AdminTokens,
+		mailInfo:        mailInfo,
+	}
+	s.version.Store(getMongodVersion(session))
+	if s.resultSizeLimit <= 0 {
+		s.resultSizeLimit = defaultResultSizeLimit
 	}
 
 	if dropFirst {
 		s.deleteExistingDB()
+	} else if err := s.reconcileDatabases(); err != nil {
+		log.Printf("fail to restore databases info: %v", err)
 	}
 
-	initPrometheusCounter(s.kvStore)
+	migrated, err := s.migrateConfigBlobs()
+	if err != nil {
+		log.Printf("fail to move configurations to blobs: %v", err)
+	}
+	if migrated > 0 {
+		log.Printf("moved configuration of %d playgrounds to blobs", migrated)
+	}
 
-	go func(s *storage) {
-		for range time.Tick(cleanupInterval) {
-			s.removeExpiredDB()
-		}
-	}(s)
+	nbCompressed, err := compressed.compressLegacyValues()
+	if err != nil {
+		log.Printf("fail to compress saved playgrounds: %v", err)
+	}
+	if nbCompressed > 0 {
+		log.Printf("compressed %d saved playgrounds", nbCompressed)
+	}
+
+	initPrometheusCounter(s.store)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	s.stopJobs = stopJobs
+	s.runPeriodically(jobsCtx, cleanupInterval, s.removeExpiredDB)
+	s.runPeriodically(jobsCtx, backupInterval, s.backup)
 
-	go func(s *storage) {
-		for range time.Tick(backupInterval) {
-			s.backup()
+	if b, ok := store.(*badgerStore); ok && opts.ValueLogGCInterval >= 0 {
+		interval := opts.ValueLogGCInterval
+		if interval == 0 {
+			interval = defaultValueLogGCInterval
 		}
-	}(s)
+		b.updateSizeMetrics()
+		s.runPeriodically(jobsCtx, interval, b.runValueLogGC)
+	}
 
 	return s, nil
 }
 
-// delete all database having a name with 32 char
+// run job every interval until ctx is done
+func (s *storage) runPeriodically(ctx context.Context, interval time.Duration, job func()) {
+
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				job()
+			}
+		}
+	}()
+}
+
+// stop the background jobs, waiting for the running ones to complete, and
+// close the playground store and mongodb connections. If dropDatabases is true, databases
+// of activeDB are dropped first.
+//
+// If the running jobs don't complete before ctx is done, they may still
+// use the store, so nothing is closed
+func (s *storage) close(ctx context.Context, dropDatabases bool) error {
+
+	s.stopJobs()
+
+	jobsDone := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		return fmt.Errorf("background jobs did not complete, storage left open: %v", ctx.Err())
+	}
+
+	if dropDatabases {
+		s.dropActiveDatabases(ctx)
+	} else {
+		s.saveLastUsed()
+	}
+
+	err := s.store.close()
+	if mongoErr := s.mongoSession.Disconnect(ctx); err == nil {
+		err = mongoErr
+	}
+	return err
+}
+
+func (s *storage) dropActiveDatabases(ctx context.Context) {
+
+	dropped := make([]string, 0)
+
+	s.activeDbLock.Lock()
+	for name := range s.activeDB {
+		if err := s.mongoSession.Database(name).Drop(ctx); err != nil {
+			log.Printf("fail to drop database %s: %v", name, err)
+			continue
+		}
+		delete(s.activeDB, name)
+		dropped = append(dropped, name)
+		activeDatabasesCounter.Dec()
+	}
+	s.activeDbLock.Unlock()
+
+	s.deleteDBMetaInfo(dropped)
+}
+
+// delete all database having a name with 32 char,
+// along with their info
 func (s *storage) deleteExistingDB() error {
 
 	dbNames, err := s.mongoSession.ListDatabaseNames(context.Background(), bson.D{})
@@ -109,8 +259,12 @@ func (s *storage) deleteExistingDB() error {
 		return err
 	}
 
+	if err = s.dbMetaCollection().Drop(context.Background()); err != nil {
+		return err
+	}
+
 	for _, name := range dbNames {
-		if len(name) == 32 {
+		if isPlaygroundDB(name) {
 			log.Printf("Deleting db '%s'", name)
 			err = s.mongoSession.Database(name).Drop(context.Background())
 			if err != nil {
@@ -121,30 +275,85 @@ func (s *storage) deleteExistingDB() error {
 	return nil
 }
 
-// remove database not used since the previous cleanup in MongoDB
+// remove database not used since the previous cleanup in MongoDB. Databases
+// used by another server sharing the same MongoDB instance are kept
 func (s *storage) removeExpiredDB() {
 
 	now := time.Now()
 
-	s.activeDbLock.Lock()
+	candidates := make([]string, 0)
+	s.activeDbLock.RLock()
 	for name, infos := range s.activeDB {
 		if now.Sub(time.Unix(infos.lastUsed, 0)) > cleanupInterval {
+			candidates = append(candidates, name)
+		}
+	}
+	for name, foundAt := range s.orphanDB {
+		if now.Sub(time.Unix(foundAt, 0)) > cleanupInterval {
+			candidates = append(candidates, name)
+		}
+	}
+	s.activeDbLock.RUnlock()
+
+	usedElsewhere, err := s.recentlyUsedDB(candidates, now)
+	if err != nil {
+		log.Printf("fail to load info of unused databases, none are dropped: %v", err)
+		usedElsewhere = map[string]int64{}
+		candidates = candidates[:0]
+	}
+
+	expired := make([]string, 0)
+	s.activeDbLock.Lock()
+	for _, name := range candidates {
+
+		if lastUsed, ok := usedElsewhere[name]; ok {
+			if infos, ok := s.activeDB[name]; ok && lastUsed > infos.lastUsed {
+				infos.lastUsed, infos.lastSaved = lastUsed, lastUsed
+				s.activeDB[name] = infos
+			}
+			// the orphan was created by another server
+			delete(s.orphanDB, name)
+			continue
+		}
+
+		if infos, ok := s.activeDB[name]; ok {
+			// the database may have been used in the meantime
+			if now.Sub(time.Unix(infos.lastUsed, 0)) <= cleanupInterval {
+				continue
+			}
 			err := s.mongoSession.Database(name).Drop(context.Background())
 			if err != nil {
 				log.Printf("fail to drop database %v: %v", name, err)
 			}
 			delete(s.activeDB, name)
+			expired = append(expired, name)
+			continue
+		}
+		if _, ok := s.orphanDB[name]; ok {
+			err := s.mongoSession.Database(name).Drop(context.Background())
+			if err != nil {
+				log.Printf("fail to drop orphan database %v: %v", name, err)
+			}
+			delete(s.orphanDB, name)
+			expired = append(expired, name)
 		}
 	}
 	s.activeDbLock.Unlock()
 
+	s.deleteDBMetaInfo(expired)
+	s.saveLastUsed()
+
 	cleanupDuration.Set(time.Since(now).Seconds())
+
+	s.activeDbLock.RLock()
 	activeDatabasesCounter.Set(float64(len(s.activeDB)))
+	activeDatabasesSize.Set(float64(s.activeDBSize()))
+	s.activeDbLock.RUnlock()
 }
 
-// create a backup from the badger db, and store it in backupDir.
-// keep a backup of last seven days only. Older backups are
-// overwritten
+// create a backup from the playground store, and store it in backupDir,
+// named after the store type like badger_3.bak. keep a backup of last
+// seven days only. Older backups are overwritten
 // upload the last backup to google drive. Previous backup is moved to trash
 // and automatically removed after 30 days
 func (s *storage) backup() {
@@ -155,9 +364,9 @@ func (s *storage) backup() {
 		os.Mkdir(s.backupDir, os.ModePerm)
 	}
 
-	fileName := fmt.Sprintf("%s/badger_%d.bak", s.backupDir, time.Now().Weekday())
+	fileName := fmt.Sprintf("%s/%s_%d.bak", s.backupDir, s.storeName, time.Now().Weekday())
 
-	err := localBackup(s.kvStore, fileName)
+	err := localBackup(s.store, fileName)
 	if err != nil {
 		s.handleBackupError("error in local backup", err)
 		return
@@ -173,8 +382,19 @@ func (s *storage) backup() {
 
 	// as backup() run once a day, also update the mongodb
 	// server version ( in case the cluster has automatically
-	// been upgraded )
-	s.mongoVersion = getMongodVersion(s.mongoSession)
+	// been upgraded ). Cached results were produced by the previous
+	// version, so drop them
+	version := getMongodVersion(s.mongoSession)
+	if !bytes.Equal(version, s.mongoVersion()) {
+		s.resultCache.purge()
+	}
+	s.version.Store(version)
+}
+
+// returns the version of mongod
+func (s *storage) mongoVersion() []byte {
+	version, _ := s.version.Load().([]byte)
+	return version
 }
 
 func (s *storage) handleBackupError(message string, err error) {
@@ -194,8 +414,12 @@ type dbMetaInfo struct {
 	collections sort.StringSlice
 	// last usage of this database, stored as Unix time
 	lastUsed int64
+	// last usage saved in MongoDB, see lastUsedSaveInterval
+	lastSaved int64
 	// true if all collections of the database are empty
 	emptyDatabase bool
+	// size in bytes of the documents and indexes
+	size int64
 }
 
 func (d *dbMetaInfo) hasCollection(collectionName string) bool {
@@ -18,17 +18,19 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/dgraph-io/badger/v2"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func TestDeleteExistingDB(t *testing.T) {
@@ -96,6 +98,221 @@ func TestRemoveExpiredDB(t *testing.T) {
 	testStorageContent(t, 1, 0)
 }
 
+func TestReconcileDatabases(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	now := time.Now()
+	recentDB, expiredDB, orphanDB, droppedDB := ephemeralDBName(), ephemeralDBName(), ephemeralDBName(), ephemeralDBName()
+	// the saved last usage may be late, so a database used by
+	// another server just before cleanupInterval is kept
+	graceDB := ephemeralDBName()
+
+	for _, name := range []string{recentDB, expiredDB, orphanDB, graceDB} {
+		testStorage.mongoSession.
+			Database(name).
+			Collection("collection").
+			InsertOne(context.Background(), bson.M{"_id": 1})
+	}
+	testStorage.dbMetaCollection().InsertMany(context.Background(), []interface{}{
+		dbMetaDocument{Name: recentDB, Collections: []string{"collection"}, LastUsed: now.Unix()},
+		dbMetaDocument{Name: expiredDB, Collections: []string{"collection"}, LastUsed: now.Add(-2 * cleanupInterval).Unix()},
+		dbMetaDocument{Name: droppedDB, Collections: []string{"collection"}, LastUsed: now.Unix()},
+		dbMetaDocument{Name: graceDB, Collections: []string{"collection"}, LastUsed: now.Add(-cleanupInterval - time.Minute).Unix()},
+	})
+
+	// simulate a restart
+	testStorage.activeDB = map[string]dbMetaInfo{}
+	if err := testStorage.reconcileDatabases(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbInfo, ok := testStorage.activeDB[recentDB]
+	if !ok || !dbInfo.hasCollection("collection") {
+		t.Errorf("recently used database %s should be restored", recentDB)
+	}
+	if _, ok := testStorage.activeDB[expiredDB]; ok {
+		t.Errorf("expired database %s should not be restored", expiredDB)
+	}
+	if _, ok := testStorage.activeDB[graceDB]; !ok {
+		t.Errorf("database %s used less than cleanupInterval + lastUsedSaveInterval ago should be restored", graceDB)
+	}
+	if _, ok := testStorage.orphanDB[orphanDB]; !ok {
+		t.Errorf("database %s should be an orphan", orphanDB)
+	}
+	// info of the expired and dropped databases is removed
+	count, _ := testStorage.dbMetaCollection().CountDocuments(context.Background(), bson.D{})
+	if want, got := int64(3), count; want != got {
+		t.Errorf("expected %d database info but got %d", want, got)
+	}
+
+	// orphans are dropped after cleanupInterval
+	testStorage.orphanDB[orphanDB] = now.Add(-2 * cleanupInterval).Unix()
+	testStorage.removeExpiredDB()
+
+	if _, ok := testStorage.orphanDB[orphanDB]; ok {
+		t.Errorf("orphan database %s should have been removed", orphanDB)
+	}
+
+	testStorageContent(t, 1, 0)
+}
+
+func TestRemoveDBUsedByOtherServer(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	now := time.Now()
+	name := ephemeralDBName()
+	testStorage.mongoSession.Database(name).Collection("collection").InsertOne(context.Background(), bson.M{"_id": 1})
+
+	// unused by this server, but used recently by another one
+	testStorage.activeDbLock.Lock()
+	testStorage.activeDB[name] = dbMetaInfo{collections: []string{"collection"}, lastUsed: now.Add(-2 * cleanupInterval).Unix()}
+	testStorage.activeDbLock.Unlock()
+	testStorage.dbMetaCollection().InsertOne(context.Background(), dbMetaDocument{Name: name, Collections: []string{"collection"}, LastUsed: now.Unix()})
+
+	testStorage.removeExpiredDB()
+
+	testStorage.activeDbLock.RLock()
+	dbInfo, ok := testStorage.activeDB[name]
+	testStorage.activeDbLock.RUnlock()
+	if !ok || dbInfo.lastUsed != now.Unix() {
+		t.Errorf("database %s used by another server should be kept, got %v, %+v", name, ok, dbInfo)
+	}
+}
+
+func TestEvictDatabases(t *testing.T) {
+
+	defer clearDatabases(t)
+	defer func() {
+		testStorage.maxActiveDB = 0
+		testStorage.maxActiveDBSize = 0
+	}()
+
+	pages := make([]*page, 4)
+	for i := range pages {
+		pages[i], _ = newPage(bsonLabel, fmt.Sprintf(`[{"_id":%d}]`, i), "db.collection.find()")
+	}
+	run := func(p *page) {
+		if _, err := testStorage.run(context.Background(), p); err != nil {
+			t.Error(err)
+		}
+	}
+
+	testStorage.maxActiveDB = 2
+
+	run(pages[0])
+	run(pages[1])
+	// lastUsed is stored in seconds, make sure the
+	// first database is the least recently used one
+	testStorage.activeDbLock.Lock()
+	for i, p := range pages[:2] {
+		dbInfo := testStorage.activeDB[p.dbHash()]
+		dbInfo.lastUsed = time.Now().Add(time.Duration(i-2) * time.Minute).Unix()
+		testStorage.activeDB[p.dbHash()] = dbInfo
+	}
+	testStorage.activeDbLock.Unlock()
+
+	evicted := testutil.ToFloat64(evictedDatabasesCounter.WithLabelValues(evictionReasonCount))
+	run(pages[2])
+
+	for i, want := range []bool{false, true, true} {
+		if _, got := testStorage.activeDB[pages[i].dbHash()]; want != got {
+			t.Errorf("expected database %d in activeDB to be %v but got %v", i, want, got)
+		}
+	}
+	if want, got := evicted+1, testutil.ToFloat64(evictedDatabasesCounter.WithLabelValues(evictionReasonCount)); want != got {
+		t.Errorf("expected %v evicted databases but got %v", want, got)
+	}
+
+	// with a size cap smaller than any database, only
+	// the database that was just created is kept
+	testStorage.maxActiveDB = 0
+	testStorage.maxActiveDBSize = 1
+	run(pages[3])
+
+	if _, ok := testStorage.activeDB[pages[3].dbHash()]; !ok {
+		t.Errorf("database just created should not be evicted")
+	}
+
+	testStorageContent(t, 1, 0)
+}
+
+func TestLeastRecentlyUsedDB(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{
+		activeDB: map[string]dbMetaInfo{
+			"inUse":    {lastUsed: 1},
+			"creating": {lastUsed: 2},
+			"keep":     {lastUsed: 3},
+			"unused":   {lastUsed: 4},
+		},
+		dbCreations: map[string]*dbCreation{"creating": {}},
+		dbUsers:     map[string]int{"inUse": 1},
+	}
+
+	if want, got := "unused", s.leastRecentlyUsedDB("keep"); want != got {
+		t.Errorf("expected %s to be evicted but got %s", want, got)
+	}
+	delete(s.activeDB, "unused")
+	if want, got := "", s.leastRecentlyUsedDB("keep"); want != got {
+		t.Errorf("expected no database to be evicted but got %s", got)
+	}
+}
+
+func TestCreateDatabaseTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	client, _ := mongo.NewClient()
+	db := client.Database("creating")
+
+	s := &storage{
+		activeDB:    map[string]dbMetaInfo{},
+		dbCreations: map[string]*dbCreation{db.Name(): {done: make(chan struct{})}},
+		dbUsers:     map[string]int{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a request timing out while waiting for the database is
+	// not reported as an error in its configuration
+	_, err := s.createDatabase(ctx, db, bsonMode, []byte("[{}]"))
+	var pErr *playgroundError
+	if !errors.As(err, &pErr) || pErr.kind != busyError {
+		t.Errorf("expected a %s error but got %v", busyError, err)
+	}
+}
+
+func TestPeriodicJobsStop(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{}
+	ctx, stop := context.WithCancel(context.Background())
+
+	var runs int64
+	s.runPeriodically(ctx, time.Millisecond, func() {
+		atomic.AddInt64(&runs, 1)
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	// once stopped, the job is not run anymore
+	stop()
+	s.jobs.Wait()
+
+	runsAfterStop := atomic.LoadInt64(&runs)
+	if runsAfterStop == 0 {
+		t.Errorf("job should have run at least once")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if want, got := runsAfterStop, atomic.LoadInt64(&runs); want != got {
+		t.Errorf("expected %d runs but got %d", want, got)
+	}
+}
+
 func TestBackup(t *testing.T) {
 
 	dir, _ := os.ReadDir(testStorage.backupDir)
@@ -111,7 +328,7 @@ func TestBackup(t *testing.T) {
 	}
 }
 
-func clearDatabases(t *testing.T) {
+func clearDatabases(t testing.TB) {
 	dbNames, err := testStorage.mongoSession.ListDatabaseNames(context.Background(), bson.D{})
 	if err != nil {
 		t.Error(err)
@@ -129,39 +346,34 @@ func clearDatabases(t *testing.T) {
 		t.Errorf("activeDB map content and databases doesn't match. Remaining keys: %v", testStorage.activeDB)
 		testStorage.activeDB = map[string]dbMetaInfo{}
 	}
+	testStorage.orphanDB = map[string]int64{}
+
+	err = testStorage.dbMetaCollection().Drop(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
 
 	// reset prometheus metrics
 	activeDatabasesCounter.Set(0)
 
+	// cached results would prevent the databases from being created again
+	testStorage.resultCache.purge()
+
 	keys := make([][]byte, 0)
-	err = testStorage.kvStore.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := make([]byte, len(item.Key()))
-			copy(key, item.Key())
-			keys = append(keys, key)
-		}
-		return err
+	err = testStorage.store.iterate(func(id, val []byte) error {
+		keys = append(keys, append([]byte(nil), id...))
+		return nil
 	})
 	if err != nil {
 		t.Error(err)
 	}
 
-	deleteTxn := testStorage.kvStore.NewTransaction(true)
 	for i := 0; i < len(keys); i++ {
-		err = deleteTxn.Delete(keys[i])
+		err = testStorage.store.delete(keys[i])
 		if err != nil {
 			t.Error(err)
 		}
 	}
-	err = deleteTxn.Commit()
-	if err != nil {
-		t.Errorf("fail to commit delete transcation: %v", err)
-	}
 }
 
 func testStorageContent(t *testing.T, nbMongoDatabases, nbBadgerRecords int) {
@@ -178,7 +390,7 @@ func testStorageContent(t *testing.T, nbMongoDatabases, nbBadgerRecords int) {
 	if want, got := nbMongoDatabases, int(testutil.ToFloat64(activeDatabasesCounter)); want != got {
 		t.Errorf("expected %d active db in prometheus counter, but got %d", want, got)
 	}
-	if want, got := nbBadgerRecords, countSavedPages(testStorage.kvStore); want != got {
+	if want, got := nbBadgerRecords, countSavedPages(testStorage.store); want != got {
 		t.Errorf("expected %d page saved, but got %d", want, got)
 	}
 }
@@ -194,14 +406,28 @@ func filterDBNames(dbNames []string) []string {
 	return r
 }
 
-func countSavedPages(kvStore *badger.DB) (count int) {
-	kvStore.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
+func countSavedPages(store playgroundStore) (count int) {
+	store.iterate(func(id, val []byte) error {
+		if isPageKey(id) {
 			count++
 		}
 		return nil
 	})
 	return count
 }
+
+// the store is not closed while a background job is still running
+func TestCloseWithRunningJob(t *testing.T) {
+
+	t.Parallel()
+
+	s := &storage{store: newMemoryStore(), stopJobs: func() {}}
+	s.jobs.Add(1)
+	defer s.jobs.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.close(ctx, false); err == nil {
+		t.Errorf("close should fail while a job is running")
+	}
+}
@@ -0,0 +1,106 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// playgrounds are saved in a local badger database
+	badgerStoreName = "badger"
+	// playgrounds are saved in a MongoDB collection, so several
+	// servers without local disk can share them
+	mongoStoreName = "mongodb"
+	// playgrounds are kept in memory and lost on restart
+	memoryStoreName = "memory"
+)
+
+var (
+	errPlaygroundNotFound = errors.New("playground not found")
+	// returned by the callback of iteratePrefix to stop the iteration
+	// early, without an error
+	errStopIteration = errors.New("stop iteration")
+)
+
+// playgroundStore persists the saved playgrounds, encoded with page.encode()
+// and identified by page.ID()
+type playgroundStore interface {
+	// get returns the playground with this id, or errPlaygroundNotFound
+	get(id []byte) ([]byte, error)
+	// putIfAbsent saves the playground, unless a playground is already saved
+	// with this id. inserted is false if the playground was already saved
+	putIfAbsent(id, val []byte) (inserted bool, err error)
+	// putIfAbsentWithTTL is like putIfAbsent, but the playground is
+	// deleted once ttl has elapsed. A ttl of 0 never expires
+	putIfAbsentWithTTL(id, val []byte, ttl time.Duration) (inserted bool, err error)
+	// update atomically replaces the value saved with this id by the value
+	// returned by fn. old is nil if nothing is saved with this id, and must
+	// not be modified. Returning a nil value deletes the id. fn may be called
+	// several times if the id is updated concurrently. The ttl of the id,
+	// if any, is kept
+	update(id []byte, fn func(old []byte) ([]byte, error)) error
+	// delete removes the playground with this id, if any
+	delete(id []byte) error
+	// iterate calls fn for each saved playground, and stops on the
+	// first error. id and val are only valid during the call
+	iterate(fn func(id, val []byte) error) error
+	// iteratePrefix is like iterate, but only for the ids starting with
+	// prefix, in ascending order of id or in descending order if reverse
+	// is true. Return errStopIteration from fn to stop early
+	iteratePrefix(prefix []byte, reverse bool, fn func(id, val []byte) error) error
+	// backup writes all saved playgrounds to w
+	backup(w io.Writer) error
+	// health returns the status of the store, as displayed by /health
+	health() serviceInfo
+	close() error
+}
+
+// returns true if the key of the playground store is the id of a page.
+// Other keys, like configuration blobs or slugs, have a prefix ending
+// with '/', which is never part of an id
+func isPageKey(key []byte) bool {
+	return len(key) == pageIDLength && bytes.IndexByte(key, '/') < 0
+}
+
+// create the store selected in the config. badgerDir and the
+// encryption keys are only used by the badger store
+func newPlaygroundStore(opts *Options, badgerDir string, mongoSession *mongo.Client) (playgroundStore, error) {
+	switch opts.Store {
+	case badgerStoreName, "":
+		key, err := parseEncryptionKey(opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		previousKey, err := parseEncryptionKey(opts.PreviousEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid previous key: %v", err)
+		}
+		return newBadgerStore(badgerDir, key, previousKey)
+	case mongoStoreName:
+		return newMongoStore(mongoSession)
+	case memoryStoreName:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("invalid playground store '%s', expecting '%s', '%s' or '%s'", opts.Store, badgerStoreName, mongoStoreName, memoryStoreName)
+}
@@ -0,0 +1,251 @@
+// mongoplayground: a sandbox to test and share MongoDB queries
+// Copyright (C) 2017 Adrien Petel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPlaygroundStores(t *testing.T) {
+
+	badgerDir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(badgerDir)
+	badgerStore, err := newBadgerStore(badgerDir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer badgerStore.close()
+
+	mongoStore := &mongoStore{
+		collection: testStorage.mongoSession.Database(metaDBName).Collection("test_playgrounds"),
+	}
+	defer mongoStore.collection.Drop(context.Background())
+
+	stores := map[string]playgroundStore{
+		badgerStoreName: badgerStore,
+		mongoStoreName:  mongoStore,
+		memoryStoreName: newMemoryStore(),
+		"compressed":    &compressedStore{newMemoryStore()},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			testPlaygroundStore(t, store)
+		})
+	}
+}
+
+func testPlaygroundStore(t *testing.T, store playgroundStore) {
+
+	id, val := []byte("nJhd-dhf3Ea"), []byte("playground")
+
+	if _, err := store.get(id); !errors.Is(err, errPlaygroundNotFound) {
+		t.Errorf("expected %v but got %v", errPlaygroundNotFound, err)
+	}
+
+	inserted, err := store.putIfAbsent(id, val)
+	if err != nil || !inserted {
+		t.Errorf("playground should be inserted, got %v, %v", inserted, err)
+	}
+	// a playground is never overwritten
+	inserted, err = store.putIfAbsent(id, []byte("other"))
+	if err != nil || inserted {
+		t.Errorf("playground should not be inserted twice, got %v, %v", inserted, err)
+	}
+
+	got, err := store.get(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if want := val; !bytes.Equal(want, got) {
+		t.Errorf("expected %s but got %s", want, got)
+	}
+
+	count := 0
+	store.iterate(func(i, v []byte) error {
+		count++
+		return nil
+	})
+	if want, got := 1, count; want != got {
+		t.Errorf("expected %d playgrounds but got %d", want, got)
+	}
+
+	for _, key := range []string{"audit/2", "audit/1", "audit/3", "auditor"} {
+		store.putIfAbsent([]byte(key), val)
+	}
+	keys := make([]string, 0)
+	store.iteratePrefix([]byte("audit/"), true, func(key, v []byte) error {
+		keys = append(keys, string(key))
+		if len(keys) == 2 {
+			return errStopIteration
+		}
+		return nil
+	})
+	if want, got := "[audit/3 audit/2]", fmt.Sprint(keys); want != got {
+		t.Errorf("expected keys %s but got %s", want, got)
+	}
+	keys = keys[:0]
+	store.iteratePrefix([]byte("audit/"), false, func(key, v []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if want, got := "[audit/1 audit/2 audit/3]", fmt.Sprint(keys); want != got {
+		t.Errorf("expected keys %s but got %s", want, got)
+	}
+	for _, key := range []string{"audit/2", "audit/1", "audit/3", "auditor"} {
+		store.delete([]byte(key))
+	}
+
+	var backup bytes.Buffer
+	if err := store.backup(&backup); err != nil || backup.Len() == 0 {
+		t.Errorf("backup should not be empty, got %d bytes, %v", backup.Len(), err)
+	}
+
+	if want, got := statusUp, store.health().Status; want != got {
+		t.Errorf("expected status %s but got %s", want, got)
+	}
+
+	if err := store.delete(id); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.get(id); !errors.Is(err, errPlaygroundNotFound) {
+		t.Errorf("expected %v but got %v", errPlaygroundNotFound, err)
+	}
+
+	inserted, err = store.putIfAbsentWithTTL(id, val, time.Hour)
+	if err != nil || !inserted {
+		t.Errorf("playground with a ttl should be inserted, got %v, %v", inserted, err)
+	}
+	if got, err := store.get(id); err != nil || !bytes.Equal(val, got) {
+		t.Errorf("expected %s but got %s, %v", val, got, err)
+	}
+	store.delete(id)
+}
+
+// backups of the mongodb and memory stores are sequences of
+// bson documents, like the files created by mongodump
+func TestMemoryStoreBackup(t *testing.T) {
+
+	t.Parallel()
+
+	store := newMemoryStore()
+	store.putIfAbsent([]byte("a"), []byte("1"))
+	store.putIfAbsent([]byte("b"), []byte("2"))
+
+	var backup bytes.Buffer
+	store.backup(&backup)
+
+	b := backup.Bytes()
+	for _, want := range []playgroundDocument{{ID: "a", Value: []byte("1")}, {ID: "b", Value: []byte("2")}} {
+
+		raw, err := bson.NewFromIOReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = b[len(raw):]
+
+		var got playgroundDocument
+		bson.Unmarshal(raw, &got)
+		if want.ID != got.ID || !bytes.Equal(want.Value, got.Value) {
+			t.Errorf("expected %v but got %v", want, got)
+		}
+	}
+}
+
+func TestBadgerStoreBackupRestore(t *testing.T) {
+
+	t.Parallel()
+
+	dir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(dir)
+
+	store, _ := newBadgerStore(dir+"/source", nil, nil)
+	defer store.close()
+	store.putIfAbsent([]byte("a"), []byte("1"))
+
+	var backup bytes.Buffer
+	store.backup(&backup)
+
+	restored, _ := newBadgerStore(dir+"/restored", nil, nil)
+	defer restored.close()
+	if err := restored.restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := restored.get([]byte("a")); err != nil || string(got) != "1" {
+		t.Errorf("expected 1 but got %s, %v", got, err)
+	}
+}
+
+func TestBadgerValueLogGC(t *testing.T) {
+
+	dir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(dir)
+
+	store, _ := newBadgerStore(dir, nil, nil)
+	defer store.close()
+	for i := 0; i < 100; i++ {
+		id := []byte(fmt.Sprintf("%d", i))
+		store.putIfAbsent(id, bytes.Repeat([]byte("a"), 1000))
+		store.delete(id)
+	}
+
+	badgerGCLastRun.Set(0)
+	store.runValueLogGC()
+
+	if testutil.ToFloat64(badgerGCLastRun) == 0 {
+		t.Errorf("last GC run time should have been set")
+	}
+	_, vlog := store.db.Size()
+	if want, got := float64(vlog), testutil.ToFloat64(badgerValueLogSize); want != got {
+		t.Errorf("expected value log size %v but got %v", want, got)
+	}
+}
+
+func TestBadgerStoreLowDiskSpace(t *testing.T) {
+
+	t.Parallel()
+
+	dir, _ := os.MkdirTemp(os.TempDir(), "store")
+	defer os.RemoveAll(dir)
+
+	store, _ := newBadgerStore(dir, nil, nil)
+	defer store.close()
+
+	if _, _, err := diskSpace(dir); err != nil {
+		t.Skipf("free disk space not available: %v", err)
+	}
+
+	// free space can't be greater than the disk size
+	store.minFreeDiskRatio = 1.1
+	if want, got := statusDegrade, store.health().Status; want != got {
+		t.Errorf("expected status %s but got %s", want, got)
+	}
+
+	store.minFreeDiskRatio = 0
+	if want, got := statusUp, store.health().Status; want != got {
+		t.Errorf("expected status %s but got %s", want, got)
+	}
+}
@@ -19,28 +19,167 @@ package internal
 import (
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/andybalholm/brotli"
-	"github.com/dgraph-io/badger/v2"
 )
 
-const errNoMatchingPlayground = "this playground doesn't exist"
+const (
+	errNoMatchingPlayground = "this playground doesn't exist"
 
-// view a saved playground page identified by its ID
+	// suffixes of the url of a saved playground, used to export
+	// its content instead of rendering the html page
+	jsonExportSuffix   = ".json"
+	configExportSuffix = "/config"
+	queryExportSuffix  = "/query"
+	// suffixes of the url of a saved playground to list its
+	// ancestors and forks, or to compare it with another one
+	historySuffix = "/history"
+	diffSuffix    = "/diff/"
+)
+
+// exported playground, returned by /p/{id}.json. Mode, Config
+// and Query can be sent as is to /api/v1/run
+type exportedPage struct {
+	Mode     string
+	Config   string
+	Query    string
+	Metadata exportMetadata
+}
+
+type exportMetadata struct {
+	ID           string
+	Type         string
+	Size         int
+	MongoVersion string
+	ExpiresAt    *time.Time `json:",omitempty"`
+}
+
+// view a saved playground page identified by its ID. Depending on the
+// url suffix, the playground can also be exported:
+//
+//   /p/nJhd-dhf3Ea.json   -> mode, config, query and metadata as json
+//   /p/nJhd-dhf3Ea/config -> raw configuration
+//   /p/nJhd-dhf3Ea/query  -> raw query
+//
+// Its revisions can also be listed and compared:
+//
+//   /p/nJhd-dhf3Ea/history           -> ancestors and forks as json
+//   /p/nJhd-dhf3Ea/diff/DYlGRQeO0bX  -> differences with DYlGRQeO0bX as plain text
 func (s *storage) viewHandler(w http.ResponseWriter, r *http.Request) {
 
-	id := extractPageIDFromURL(r.URL.Path)
+	id, suffix := s.extractPageIDFromURL(r.URL.Path)
+
+	records, err := s.loadPageRecords(id)
+	if err != nil {
+		log.Printf("fail to load records of page with id %s : %v", id, err)
+		serveNoMatchingPlayground(w)
+		return
+	}
+	accessErr := checkAccess(r, records.access)
+
+	// a tombstoned private playground is only reported
+	// as taken down to its readers
+	if records.tombstone != nil && accessErr == nil {
+		serveTakenDownPlayground(w)
+		return
+	}
 
 	page, err := s.loadPage(id)
 	if err != nil {
 		log.Printf("fail to load page with id %s : %v", id, err)
+		// the expiry of a playground is recorded
+		// longer than the playground itself
+		if errors.Is(err, errPlaygroundNotFound) && !records.expiresAt.IsZero() && accessErr == nil {
+			serveExpiredPlayground(w)
+			return
+		}
+		serveNoMatchingPlayground(w)
+		return
+	}
+
+	// without its read token, a private playground
+	// is answered as if it doesn't exist
+	switch {
+	case errors.Is(accessErr, errInvalidPassword):
+		w.Header().Set("WWW-Authenticate", `Basic realm="private playground"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case accessErr != nil:
 		serveNoMatchingPlayground(w)
 		return
 	}
+	if records.access != nil {
+		// keep the token out of caches and of the Referer
+		// header sent to other sites
+		w.Header().Set("Cache-Control", "private, no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+	}
+	page.ExpiresAt = records.expiresAt
+
+	var expiresAt *time.Time
+	if !page.ExpiresAt.IsZero() {
+		expiresAt = &page.ExpiresAt
+	}
+
+	switch suffix {
+	case jsonExportSuffix:
+		writeJSON(w, http.StatusOK, exportedPage{
+			Mode:   page.modeName(),
+			Config: string(page.Config),
+			Query:  string(page.Query),
+			Metadata: exportMetadata{
+				ID:           string(id),
+				Type:         page.label(),
+				Size:         len(page.Config) + len(page.Query),
+				MongoVersion: string(page.MongoVersion),
+				ExpiresAt:    expiresAt,
+			},
+		})
+		return
+	case configExportSuffix:
+		serveRawContent(w, page.Config, fmt.Sprintf("%s-config.txt", id))
+		return
+	case queryExportSuffix:
+		serveRawContent(w, page.Query, fmt.Sprintf("%s-query.txt", id))
+		return
+	case historySuffix:
+		history, err := s.history(id)
+		if err != nil {
+			log.Printf("fail to load history of page %s: %v", id, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, history)
+		return
+	}
+
+	if strings.HasPrefix(suffix, diffSuffix) {
+		otherID, _ := s.extractPageIDFromURL(strings.TrimPrefix(suffix, diffSuffix))
+		other, err := s.loadPage(otherID)
+		var otherRecords *pageRecords
+		if err == nil {
+			otherRecords, err = s.loadPageRecords(otherID)
+		}
+		if err == nil && otherRecords.access != nil {
+			err = errInvalidToken
+		}
+		if err == nil && otherRecords.tombstone != nil {
+			err = errors.New("playground is tombstoned")
+		}
+		if err != nil {
+			log.Printf("fail to load page with id %s : %v", otherID, err)
+			serveNoMatchingPlayground(w)
+			return
+		}
+		serveDiff(w, id, page, otherID, other)
+		return
+	}
 
 	var writer io.WriteCloser
 	if strings.Contains(r.Header.Get("Accept-Encoding"), brotliEncoding) {
@@ -56,13 +195,66 @@ func (s *storage) viewHandler(w http.ResponseWriter, r *http.Request) {
 	writer.Close()
 }
 
-func extractPageIDFromURL(url string) []byte {
+// return the id of the page and anything following it in the url,
+// for example "/p/nJhd-dhf3Ea/config" gives "nJhd-dhf3Ea" and "/config".
+// If the url starts with a slug, like "/p/lookup-unwind-demo.json", the
+// id of the page aliased by the slug is returned
+func (s *storage) extractPageIDFromURL(url string) (id []byte, suffix string) {
+
+	path := strings.TrimPrefix(url, viewEndpoint)
+
+	slug := path
+	if end := strings.IndexAny(path, "./"); end >= 0 {
+		slug, suffix = path[:end], path[end:]
+	}
+	if isValidSlug(slug) {
+		if id, err := s.resolveSlug([]byte(slug)); err == nil {
+			return id, suffix
+		}
+	}
 
-	id := strings.TrimPrefix(url, viewEndpoint)
-	if len(id) > pageIDLength {
-		id = id[:pageIDLength]
+	if len(path) > pageIDLength {
+		return []byte(path[:pageIDLength]), path[pageIDLength:]
 	}
-	return []byte(id)
+	return []byte(path), ""
+}
+
+// records saved along a playground that change how it's served,
+// loaded at once by loadPageRecords
+type pageRecords struct {
+	// access record of a private playground, nil if it's public
+	access []byte
+	// expiration date, or the zero time if it never expires
+	expiresAt time.Time
+	// nil unless the playground was taken down
+	tombstone *tombstone
+}
+
+func (s *storage) loadPageRecords(id []byte) (*pageRecords, error) {
+
+	records := &pageRecords{}
+	access, err := s.store.get(accessKey(id))
+	if err == nil {
+		records.access = access
+	}
+	if err != nil && !errors.Is(err, errPlaygroundNotFound) {
+		return nil, err
+	}
+	v, err := s.store.get(expiryKey(id))
+	if err == nil {
+		records.expiresAt = decodeExpiry(v)
+	}
+	if err != nil && !errors.Is(err, errPlaygroundNotFound) {
+		return nil, err
+	}
+	v, err = s.store.get(tombstoneKey(id))
+	if err == nil {
+		records.tombstone = decodeTombstone(id, v)
+	}
+	if err != nil && !errors.Is(err, errPlaygroundNotFound) {
+		return nil, err
+	}
+	return records, nil
 }
 
 func (s *storage) loadPage(id []byte) (*page, error) {
@@ -72,19 +264,26 @@ func (s *storage) loadPage(id []byte) (*page, error) {
 	}
 
 	p := &page{
-		MongoVersion: s.mongoVersion,
+		MongoVersion: s.mongoVersion(),
+	}
+	val, err := s.store.get(id)
+	if err != nil {
+		return nil, err
 	}
-	err := s.kvStore.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(id)
+	p.decode(val)
+	if ref := configRef(val); ref != nil {
+		p.Config, err = s.loadConfigBlob(ref)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		return item.Value(func(val []byte) error {
-			p.decode(val)
-			return nil
-		})
-	})
-	return p, err
+	}
+	return p, nil
+}
+
+func serveRawContent(w http.ResponseWriter, content []byte, fileName string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
+	w.Write(content)
 }
 
 func serveNoMatchingPlayground(w http.ResponseWriter) {
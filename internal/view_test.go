@@ -17,8 +17,10 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 )
@@ -88,3 +90,90 @@ func TestView(t *testing.T) {
 		}
 	})
 }
+
+func TestExport(t *testing.T) {
+
+	defer clearDatabases(t)
+
+	params := url.Values{
+		"mode":   {"bson"},
+		"config": {`[{"_id": 1}]`},
+		"query":  {templateQuery},
+	}
+	httpBody(t, saveEndpoint, http.MethodPost, params)
+	id := "DEz-pkpheLX"
+
+	exportTests := []struct {
+		name         string
+		url          string
+		responseCode int
+		contentType  string
+		body         string
+	}{
+		{
+			name:         "raw config",
+			url:          "/p/" + id + "/config",
+			responseCode: http.StatusOK,
+			contentType:  "text/plain; charset=utf-8",
+			body:         params.Get("config"),
+		},
+		{
+			name:         "raw query",
+			url:          "/p/" + id + "/query",
+			responseCode: http.StatusOK,
+			contentType:  "text/plain; charset=utf-8",
+			body:         params.Get("query"),
+		},
+		{
+			name:         "json export",
+			url:          "/p/" + id + ".json",
+			responseCode: http.StatusOK,
+			contentType:  "application/json; charset=utf-8",
+		},
+		{
+			name:         "export non existing playground",
+			url:          "/p/unknownURL.json",
+			responseCode: http.StatusNotFound,
+			contentType:  "text/plain; charset=utf-8",
+			body:         errNoMatchingPlayground,
+		},
+	}
+
+	for _, tt := range exportTests {
+
+		test := tt // capture range variable
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, test.url, nil)
+			testServer.Handler.ServeHTTP(resp, req)
+
+			if want, got := test.responseCode, resp.Code; want != got {
+				t.Errorf("expected response code %d but got %d", want, got)
+			}
+			if want, got := test.contentType, resp.Header().Get("Content-Type"); want != got {
+				t.Errorf("expected Content-Type: %s, but got %s", want, got)
+			}
+			if test.body != "" {
+				if want, got := test.body, resp.Body.String(); want != got {
+					t.Errorf("expected %s but got %s", want, got)
+				}
+			}
+		})
+	}
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/p/"+id+".json", nil)
+	testServer.Handler.ServeHTTP(resp, req)
+
+	var exported exportedPage
+	if err := json.Unmarshal(resp.Body.Bytes(), &exported); err != nil {
+		t.Errorf("fail to decode exported page: %v", err)
+	}
+	if exported.Mode != params.Get("mode") || exported.Config != params.Get("config") || exported.Query != params.Get("query") {
+		t.Errorf("exported page doesn't match saved playground: %+v", exported)
+	}
+	if want, got := bsonSingleCollectionLabel, exported.Metadata.Type; want != got {
+		t.Errorf("expected type %s but got %s", want, got)
+	}
+}
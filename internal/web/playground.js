@@ -8,6 +8,10 @@ var configEditor,
 
     parser,
 
+    // id or slug of the playground loaded in the page, sent as
+    // the parent of the playgrounds saved from it
+    parentID = "",
+
     hasChangedSinceLastRun = true,
     hasChangedSinceLastSave = true,
     isConfigHandlerDragging = false,
@@ -17,6 +21,12 @@ window.onload = function () {
 
     parser = new Parser()
 
+    // the url is replaced by "/" on the first edit, so it
+    // can't be read from the Referer header when saving
+    if (window.location.pathname.startsWith("/p/")) {
+        parentID = window.location.pathname.substring("/p/".length)
+    }
+
     comboMode = new CustomSelect({
         elem: 'mode',
         onChange: function () { checkEditorContent(configEditor, 'config') }
@@ -209,11 +219,16 @@ function run() {
                 var response = r.responseText
                 if (response.startsWith("[") || response.startsWith("{")) {
                     showResult(response, true)
+                    if (r.getResponseHeader("X-Result-Truncated") === "true") {
+                        showTruncatedWarning(r.getResponseHeader("X-Result-Count"), r.getResponseHeader("X-Result-Total"))
+                    }
                 } else if (response === "no document found") {
                     showResult(response, false)
                 } else {
                     showError(response)
                 }
+            } else {
+                showError(r.responseText)
             }
         }
         r.send(encodePlayground(false))
@@ -234,10 +249,13 @@ function save() {
             hasChangedSinceLastSave = false
             var response = r.responseText
             if (response.startsWith("http")) {
+                parentID = response.substring(response.lastIndexOf("/p/") + "/p/".length)
                 redirect(response, true)
             } else {
                 showError(response)
             }
+        } else {
+            showError(r.responseText)
         }
     }
     r.send(encodePlayground(true))
@@ -252,6 +270,9 @@ function encodePlayground(keepComment) {
         result += "&config=" + encodeURIComponent(parser.compactAndRemoveComment(configEditor.getValue(), "config", comboMode.getValue()))
             + "&query=" + encodeURIComponent(parser.compactAndRemoveComment(queryEditor.getValue(), "query", comboMode.getValue()))
     }
+    if (parentID !== "") {
+        result += "&parent=" + encodeURIComponent(parentID)
+    }
     return result
 }
 
@@ -287,6 +308,10 @@ function showError(errMsg) {
     resultEditor.setValue(errMsg, -1)
 }
 
+function showTruncatedWarning(count, total) {
+    resultEditor.setValue(resultEditor.getValue() + "\n\n// result truncated: only the first " + count + " documents out of at least " + total + " are displayed", -1)
+}
+
 function showResult(result, doIndent) {
     document.getElementById("result").classList.remove("text_red")
     if (doIndent) {
@@ -17,8 +17,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/feliixx/mongoplayground/internal"
@@ -29,12 +33,18 @@ import (
 const (
 	badgerDir = "storage"
 	backupDir = "backups"
+	// max time to wait for running requests to complete on shutdown
+	shutdownTimeout = 30 * time.Second
 )
 
 func main() {
 
+	// stop the server on SIGTERM, sent by docker on redeploy, or on ctrl+c
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	loadConfig()
-	setLogger()
+	logger := setLogger(ctx)
 
 	s, err := internal.NewServer(
 		viper.GetString("mongo.uri"),
@@ -42,27 +52,56 @@ func main() {
 		badgerDir,
 		backupDir,
 		loadSmtp(),
+		loadOptions(),
 	)
 	if err != nil {
 		log.Fatalf("aborting: %v\n", err)
 	}
 
+	var redirect *http.Server
+
 	if !viper.GetBool("https.enabled") {
-		log.Fatal(s.ListenAndServe())
-		return
+		go listen(s.ListenAndServe)
+	} else {
+		redirect = &http.Server{Addr: ":80", Handler: http.HandlerFunc(redirectTLS)}
+		go listen(redirect.ListenAndServe)
+
+		s.Addr = ":443"
+		go listen(func() error {
+			return s.ListenAndServeTLS(
+				viper.GetString("https.fullchain"),
+				viper.GetString("https.privkey"),
+			)
+		})
 	}
 
-	go func() {
-		if err := http.ListenAndServe(":80", http.HandlerFunc(redirectTLS)); err != nil {
-			log.Fatalf("ListenAndServe error: %v", err)
+	<-ctx.Done()
+	stop()
+	log.Print("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		redirect.Shutdown(shutdownCtx)
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error during shutdown: %v", err)
+	}
+
+	// send the remaining logs, including the ones of the shutdown
+	if logger != nil {
+		if err := logger.Send(); err != nil {
+			log.SetOutput(os.Stderr)
+			log.Printf("fail to send to loki: %v", err)
 		}
-	}()
+	}
+}
 
-	s.Addr = ":443"
-	log.Fatal(s.ListenAndServeTLS(
-		viper.GetString("https.fullchain"),
-		viper.GetString("https.privkey"),
-	))
+func listen(serve func() error) {
+	if err := serve(); err != http.ErrServerClosed {
+		log.Fatalf("ListenAndServe error: %v", err)
+	}
 }
 
 func loadConfig() {
@@ -71,8 +110,22 @@ func loadConfig() {
 	viper.SetDefault("https.enabled", false)
 	viper.SetDefault("mongo.uri", "mongodb://localhost:27017")
 	viper.SetDefault("mongo.dropFirst", false)
+	viper.SetDefault("mongo.dropOnShutdown", false)
+	viper.SetDefault("mongo.maxActiveDatabases", 0)
+	viper.SetDefault("mongo.maxActiveDatabasesSize", 0)
+	viper.SetDefault("storage.type", "badger")
+	viper.SetDefault("storage.gcInterval", 0)
+	viper.SetDefault("storage.encryptionKeyFile", "")
+	viper.SetDefault("storage.previousEncryptionKeyFile", "")
 	viper.SetDefault("logging.loki.host", "")
 	viper.SetDefault("mail.enabled", false)
+	viper.SetDefault("cors.allowedOrigins", []string{})
+	viper.SetDefault("run.resultSizeLimit", 0)
+	viper.SetDefault("run.resultCacheSize", 0)
+	viper.SetDefault("run.maxConcurrentRuns", 0)
+	viper.SetDefault("run.maxQueuedRuns", 0)
+	viper.SetDefault("rateLimit.trustedProxies", []string{})
+	viper.SetDefault("rateLimit.allowList", []string{})
 	viper.AddConfigPath(".")
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -80,25 +133,36 @@ func loadConfig() {
 	}
 }
 
-func setLogger() {
+// send logs to loki if it's configured, until ctx is done
+func setLogger(ctx context.Context) *internal.LokiLogger {
 
-	if viper.GetString("logging.loki.host") != "" {
-
-		logger := internal.NewLokiLogger(
-			viper.GetString("logging.loki.host"),
-			viper.GetInt("logging.loki.port"),
-		)
-		log.SetOutput(logger)
+	if viper.GetString("logging.loki.host") == "" {
+		return nil
+	}
 
-		go func(l *internal.LokiLogger) {
-			for range time.Tick(5 * time.Minute) {
+	logger := internal.NewLokiLogger(
+		viper.GetString("logging.loki.host"),
+		viper.GetInt("logging.loki.port"),
+	)
+	log.SetOutput(logger)
+
+	go func(l *internal.LokiLogger) {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 				err := l.Send()
 				if err != nil {
 					log.Printf("fail to send to loki: %v", err)
 				}
 			}
-		}(logger)
-	}
+		}
+	}(logger)
+
+	return logger
 }
 
 func loadSmtp() *internal.MailInfo {
@@ -117,6 +181,53 @@ func loadSmtp() *internal.MailInfo {
 	}
 }
 
+func loadOptions() *internal.Options {
+	return &internal.Options{
+		AllowedOrigins:          viper.GetStringSlice("cors.allowedOrigins"),
+		ResultSizeLimit:         viper.GetInt("run.resultSizeLimit"),
+		ResultCacheSize:         viper.GetInt("run.resultCacheSize"),
+		MaxConcurrentRuns:       viper.GetInt("run.maxConcurrentRuns"),
+		MaxQueuedRuns:           viper.GetInt("run.maxQueuedRuns"),
+		RateLimits:              loadRateLimits(),
+		TrustedProxies:          viper.GetStringSlice("rateLimit.trustedProxies"),
+		RateLimitAllowList:      viper.GetStringSlice("rateLimit.allowList"),
+		MaxActiveDatabases:      viper.GetInt("mongo.maxActiveDatabases"),
+		MaxActiveDatabasesSize:  viper.GetInt64("mongo.maxActiveDatabasesSize"),
+		Store:                   viper.GetString("storage.type"),
+		ValueLogGCInterval:      viper.GetDuration("storage.gcInterval"),
+		EncryptionKey:           loadEncryptionKey("storage.encryptionKeyFile", "BADGER_ENCRYPTION_KEY"),
+		PreviousEncryptionKey:   loadEncryptionKey("storage.previousEncryptionKeyFile", "BADGER_PREVIOUS_ENCRYPTION_KEY"),
+		SlugTokens:              viper.GetStringSlice("slugs.tokens"),
+		AdminTokens:             viper.GetStringSlice("admin.tokens"),
+		DropDatabasesOnShutdown: viper.GetBool("mongo.dropOnShutdown"),
+	}
+}
+
+func loadRateLimits() map[string]internal.RateLimit {
+
+	limits := map[string]internal.RateLimit{}
+	err := viper.UnmarshalKey("rateLimit.endpoints", &limits)
+	if err != nil {
+		log.Printf("invalid rate limits, requests won't be throttled: %v", err)
+	}
+	return limits
+}
+
+// read the hex encoded key from the file set in the config, or
+// from the env variable if no file is set
+func loadEncryptionKey(fileConfigKey, envVariable string) string {
+
+	fileName := viper.GetString(fileConfigKey)
+	if fileName == "" {
+		return os.Getenv(envVariable)
+	}
+	key, err := os.ReadFile(fileName)
+	if err != nil {
+		log.Fatalf("aborting: fail to read encryption key: %v\n", err)
+	}
+	return string(key)
+}
+
 func redirectTLS(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusMovedPermanently)
 }